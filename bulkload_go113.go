@@ -0,0 +1,148 @@
+// Go MySQL Driver - A MySQL-Driver for Go's database/sql package
+//
+// Copyright 2020 The Go-MySQL-Driver Authors. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build go1.13
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// parallelBulkLoads makes the Reader names of concurrent ParallelBulkLoad
+// calls unique.
+var parallelBulkLoads uint64
+
+// ParallelBulkLoad loads the sources into table with
+// "LOAD DATA LOCAL INFILE" on up to parallelism pooled connections at once.
+// Each source is loaded with a separate statement through a temporary
+// Reader handler; table is inserted into the statement verbatim.
+// Sources implementing io.Closer are always closed, also if they were not
+// loaded because of an error.
+// It returns the total number of rows affected. After the first error no
+// further sources are started, but the loads already running are finished,
+// so some sources might have been loaded completely.
+//
+//  rows, err := mysql.ParallelBulkLoad(db, "foo", []io.Reader{part1, part2}, 2)
+//  if err != nil {
+//  ...
+//
+func ParallelBulkLoad(db *sql.DB, table string, sources []io.Reader, parallelism int) (int64, error) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	if parallelism > len(sources) {
+		parallelism = len(sources)
+	}
+	id := atomic.AddUint64(&parallelBulkLoads, 1)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		rows     int64
+		firstErr error
+	)
+	jobs := make(chan int)
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				mu.Lock()
+				failed := firstErr != nil
+				mu.Unlock()
+				if failed {
+					closeSource(sources[i])
+					continue
+				}
+
+				affected, err := bulkLoad(db, table, fmt.Sprintf("parallelBulkLoad-%d-%d", id, i), sources[i])
+				mu.Lock()
+				rows += affected
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	next := 0
+	for ; next < len(sources); next++ {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		jobs <- next
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, source := range sources[next:] {
+		closeSource(source)
+	}
+	return rows, firstErr
+}
+
+// closeSource closes source if it implements io.Closer.
+func closeSource(source io.Reader) {
+	if closer, ok := source.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// bulkLoad loads source into table on a single pooled connection.
+func bulkLoad(db *sql.DB, table string, name string, source io.Reader) (int64, error) {
+	// the driver closes the source only if the server requested it
+	requested := false
+	defer func() {
+		if !requested {
+			closeSource(source)
+		}
+	}()
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// register the Reader in the registry of the connection
+	var registry *InfileRegistry
+	err = conn.Raw(func(driverConn interface{}) error {
+		mc, ok := driverConn.(*mysqlConn)
+		if !ok {
+			return errors.New("ParallelBulkLoad requires connections of this driver")
+		}
+		registry = mc.infileRegistry()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	registry.RegisterReaderHandler(name, func() io.Reader {
+		requested = true
+		return source
+	})
+	defer registry.DeregisterReaderHandler(name)
+
+	res, err := conn.ExecContext(ctx, "LOAD DATA LOCAL INFILE 'Reader::"+name+"' INTO TABLE "+table)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,73 @@
+// Go MySQL Driver - A MySQL-Driver for Go's database/sql package
+//
+// Copyright 2020 The Go-MySQL-Driver Authors. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build go1.13
+
+package mysql
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParallelBulkLoad(t *testing.T) {
+	runTests(t, dsn, func(dbt *DBTest) {
+		dbt.mustExec("CREATE TABLE test (id INT NOT NULL PRIMARY KEY, value TEXT NOT NULL)")
+
+		var sources []io.Reader
+		for i := 0; i < 4; i++ {
+			var rows strings.Builder
+			for j := 1; j <= 25; j++ {
+				fmt.Fprintf(&rows, "%d\tsource %d\n", i*25+j, i)
+			}
+			sources = append(sources, strings.NewReader(rows.String()))
+		}
+
+		rows, err := ParallelBulkLoad(dbt.db, "test", sources, 2)
+		if err != nil {
+			dbt.Fatal(err)
+		}
+		if rows != 100 {
+			dbt.Errorf("expected 100 rows affected, got %d", rows)
+		}
+
+		var count int
+		if err := dbt.db.QueryRow("SELECT COUNT(*) FROM test").Scan(&count); err != nil {
+			dbt.Fatal(err)
+		}
+		if count != 100 {
+			dbt.Errorf("expected 100 rows, got %d", count)
+		}
+		if handlers := RegisteredReaderHandlers(); len(handlers) != 0 {
+			dbt.Errorf("expected temporary Reader handlers to be removed, got %v", handlers)
+		}
+
+		// a failing source fails the load, later sources are closed anyway
+		readErr := errors.New("read failed")
+		skipped := &closeRecorder{Reader: strings.NewReader("101\tskipped\n")}
+		_, err = ParallelBulkLoad(dbt.db, "test", []io.Reader{errReader{readErr}, skipped}, 1)
+		if err != readErr {
+			dbt.Errorf("expected %v, got %v", readErr, err)
+		}
+		if !skipped.closed {
+			dbt.Error("source after the failed load was not closed")
+		}
+
+		// sources are closed if the server never requests them
+		unused := &closeRecorder{Reader: strings.NewReader("1\tunused\n")}
+		if _, err = ParallelBulkLoad(dbt.db, "doesnotexist", []io.Reader{unused}, 1); err == nil {
+			dbt.Error("expected error for a missing table")
+		}
+		if !unused.closed {
+			dbt.Error("source of a failed statement was not closed")
+		}
+	})
+}
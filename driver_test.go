@@ -14,6 +14,7 @@ import (
 	"crypto/tls"
 	"database/sql"
 	"database/sql/driver"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -1275,6 +1276,29 @@ func TestLoadData(t *testing.T) {
 	})
 }
 
+func TestLoadDataGeometry(t *testing.T) {
+	runTests(t, dsn, func(dbt *DBTest) {
+		dbt.mustExec("CREATE TABLE test (id INT NOT NULL PRIMARY KEY, value GEOMETRY NOT NULL)")
+
+		// WKB of POINT(1 2), hex-encoded since the data is sent as text
+		wkb := []byte{0x01, 0x01, 0x00, 0x00, 0x00, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f, 0, 0, 0, 0, 0, 0, 0x00, 0x40}
+		RegisterReaderHandler("geometry", func() io.Reader {
+			return strings.NewReader("1\t" + hex.EncodeToString(wkb) + "\n")
+		})
+		defer DeregisterReaderHandler("geometry")
+
+		dbt.mustExec("LOAD DATA LOCAL INFILE 'Reader::geometry' INTO TABLE test (id, @g) SET value = ST_GeomFromWKB(UNHEX(@g))")
+
+		var point string
+		if err := dbt.db.QueryRow("SELECT ST_AsText(value) FROM test WHERE id = 1").Scan(&point); err != nil {
+			dbt.Fatal(err)
+		}
+		if point != "POINT(1 2)" {
+			dbt.Fatalf("unexpected geometry: %s", point)
+		}
+	})
+}
+
 func TestFoundRows(t *testing.T) {
 	runTests(t, dsn, func(dbt *DBTest) {
 		dbt.mustExec("CREATE TABLE test (id INT NOT NULL ,data INT NOT NULL)")
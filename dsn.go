@@ -14,6 +14,7 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"hash"
 	"math/big"
 	"net"
 	"net/url"
@@ -34,22 +35,27 @@ var (
 // If a new Config is created instead of being parsed from a DSN string,
 // the NewConfig function should be used, which sets default values.
 type Config struct {
-	User             string            // Username
-	Passwd           string            // Password (requires User)
-	Net              string            // Network type
-	Addr             string            // Network address (requires Net)
-	DBName           string            // Database name
-	Params           map[string]string // Connection parameters
-	Collation        string            // Connection collation
-	Loc              *time.Location    // Location for time.Time values
-	MaxAllowedPacket int               // Max packet size allowed
-	ServerPubKey     string            // Server public key name
-	pubKey           *rsa.PublicKey    // Server public key
-	TLSConfig        string            // TLS configuration name
-	tls              *tls.Config       // TLS configuration
-	Timeout          time.Duration     // Dial timeout
-	ReadTimeout      time.Duration     // I/O read timeout
-	WriteTimeout     time.Duration     // I/O write timeout
+	User                   string            // Username
+	Passwd                 string            // Password (requires User)
+	Net                    string            // Network type
+	Addr                   string            // Network address (requires Net)
+	DBName                 string            // Database name
+	Params                 map[string]string // Connection parameters
+	Collation              string            // Connection collation
+	Loc                    *time.Location    // Location for time.Time values
+	MaxAllowedPacket       int               // Max packet size allowed
+	ServerPubKey           string            // Server public key name
+	pubKey                 *rsa.PublicKey    // Server public key
+	TLSConfig              string            // TLS configuration name
+	tls                    *tls.Config       // TLS configuration
+	Timeout                time.Duration     // Dial timeout
+	ReadTimeout            time.Duration     // I/O read timeout
+	WriteTimeout           time.Duration     // I/O write timeout
+	LocalInfileDir         string            // Directory all LOAD DATA LOCAL INFILE files must be located in
+	InfileOpenRetries      int               // Retries of opening a missing LOAD DATA LOCAL INFILE file
+	InfileOpenBackoff      time.Duration     // Wait before the first retry, doubled for every further retry
+	InfilePacketSize       int               // Max payload size of LOAD DATA LOCAL INFILE packets
+	InfileReaderTerminator string            // Line terminator appended to LOAD DATA LOCAL INFILE Readers not ending with it
 
 	AllowAllFiles           bool // Allow all files to be used with LOAD DATA LOCAL INFILE
 	AllowCleartextPasswords bool // Allows the cleartext client side plugin
@@ -58,10 +64,41 @@ type Config struct {
 	CheckConnLiveness       bool // Check connections for liveness before using them
 	ClientFoundRows         bool // Return number of matching rows instead of rows changed
 	ColumnsWithAlias        bool // Prepend table alias to column names
+	InfileAbortOnError      bool // Close the connection instead of finishing LOAD DATA LOCAL INFILE on read errors
+	InfileReadAhead         bool // Read ahead while sending LOAD DATA LOCAL INFILE data
 	InterpolateParams       bool // Interpolate placeholders into query string
 	MultiStatements         bool // Allow multiple statements in one query
 	ParseTime               bool // Parse time values to time.Time
 	RejectReadOnly          bool // Reject read-only connections
+
+	// InfileProgress is called with the total number of bytes sent so far
+	// after each packet of a LOAD DATA LOCAL INFILE request.
+	InfileProgress func(bytesSent int64)
+
+	// InfileChecksum returns a hash which is fed with all bytes sent for a
+	// LOAD DATA LOCAL INFILE request of the given file or Reader name.
+	// Returning nil disables checksumming for that request.
+	InfileChecksum func(name string) hash.Hash
+
+	// InfileInfo is called with the counters the server reported after a
+	// LOAD DATA LOCAL INFILE request of the given file or Reader name
+	// succeeded.
+	InfileInfo func(name string, info LoadDataInfo)
+
+	// InfileAuditLog is called after each LOAD DATA LOCAL INFILE request
+	// with the requested name, the local file, whether it was allowed, the
+	// bytes sent and the error, if any.
+	InfileAuditLog func(event InfileAuditEvent)
+
+	// InfileRegistry replaces the global file whitelist and Reader handlers
+	// for LOAD DATA LOCAL INFILE, if set. It is shared by clones of Config.
+	InfileRegistry *InfileRegistry
+
+	// AllowAllFilesPeerUID restricts AllowAllFiles to Unix socket
+	// connections to a server process running as a UID it accepts. The UID
+	// is read with SO_PEERCRED, which is only supported on Linux. Files which
+	// are not whitelisted are rejected on all other connections.
+	AllowAllFilesPeerUID func(uid int) bool
 }
 
 // NewConfig creates a new Config and sets default values.
@@ -228,6 +265,30 @@ func (cfg *Config) FormatDSN() string {
 		writeDSNParam(&buf, &hasParam, "columnsWithAlias", "true")
 	}
 
+	if cfg.InfileAbortOnError {
+		writeDSNParam(&buf, &hasParam, "infileAbortOnError", "true")
+	}
+
+	if cfg.InfileOpenBackoff > 0 {
+		writeDSNParam(&buf, &hasParam, "infileOpenBackoff", cfg.InfileOpenBackoff.String())
+	}
+
+	if cfg.InfileOpenRetries > 0 {
+		writeDSNParam(&buf, &hasParam, "infileOpenRetries", strconv.Itoa(cfg.InfileOpenRetries))
+	}
+
+	if cfg.InfilePacketSize > 0 {
+		writeDSNParam(&buf, &hasParam, "infilePacketSize", strconv.Itoa(cfg.InfilePacketSize))
+	}
+
+	if cfg.InfileReadAhead {
+		writeDSNParam(&buf, &hasParam, "infileReadAhead", "true")
+	}
+
+	if len(cfg.InfileReaderTerminator) > 0 {
+		writeDSNParam(&buf, &hasParam, "infileReaderTerminator", url.QueryEscape(cfg.InfileReaderTerminator))
+	}
+
 	if cfg.InterpolateParams {
 		writeDSNParam(&buf, &hasParam, "interpolateParams", "true")
 	}
@@ -236,6 +297,10 @@ func (cfg *Config) FormatDSN() string {
 		writeDSNParam(&buf, &hasParam, "loc", url.QueryEscape(cfg.Loc.String()))
 	}
 
+	if len(cfg.LocalInfileDir) > 0 {
+		writeDSNParam(&buf, &hasParam, "localInfileDir", url.QueryEscape(cfg.LocalInfileDir))
+	}
+
 	if cfg.MultiStatements {
 		writeDSNParam(&buf, &hasParam, "multiStatements", "true")
 	}
@@ -439,6 +504,49 @@ func parseDSNParams(cfg *Config, params string) (err error) {
 		case "compress":
 			return errors.New("compression not implemented yet")
 
+		// Close the connection on LOAD DATA LOCAL INFILE read errors
+		case "infileAbortOnError":
+			var isBool bool
+			cfg.InfileAbortOnError, isBool = readBool(value)
+			if !isBool {
+				return errors.New("invalid bool value: " + value)
+			}
+
+		// Wait before retrying to open a LOAD DATA LOCAL INFILE file
+		case "infileOpenBackoff":
+			cfg.InfileOpenBackoff, err = time.ParseDuration(value)
+			if err != nil {
+				return
+			}
+
+		// Retries of opening a missing LOAD DATA LOCAL INFILE file
+		case "infileOpenRetries":
+			cfg.InfileOpenRetries, err = strconv.Atoi(value)
+			if err != nil {
+				return
+			}
+
+		// Max payload size of LOAD DATA LOCAL INFILE packets
+		case "infilePacketSize":
+			cfg.InfilePacketSize, err = strconv.Atoi(value)
+			if err != nil {
+				return
+			}
+
+		// Read ahead while sending LOAD DATA LOCAL INFILE data
+		case "infileReadAhead":
+			var isBool bool
+			cfg.InfileReadAhead, isBool = readBool(value)
+			if !isBool {
+				return errors.New("invalid bool value: " + value)
+			}
+
+		// Line terminator appended to LOAD DATA LOCAL INFILE Readers
+		case "infileReaderTerminator":
+			if cfg.InfileReaderTerminator, err = url.QueryUnescape(value); err != nil {
+				return
+			}
+
 		// Enable client side placeholder substitution
 		case "interpolateParams":
 			var isBool bool
@@ -457,6 +565,12 @@ func parseDSNParams(cfg *Config, params string) (err error) {
 				return
 			}
 
+		// Restrict LOAD DATA LOCAL INFILE to a directory
+		case "localInfileDir":
+			if cfg.LocalInfileDir, err = url.QueryUnescape(value); err != nil {
+				return
+			}
+
 		// multiple statements in one query
 		case "multiStatements":
 			var isBool bool
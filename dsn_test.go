@@ -47,6 +47,9 @@ var testDSNs = []struct {
 }, {
 	"user:p@ss(word)@tcp([de:ad:be:ef::ca:fe]:80)/dbname?loc=Local",
 	&Config{User: "user", Passwd: "p@ss(word)", Net: "tcp", Addr: "[de:ad:be:ef::ca:fe]:80", DBName: "dbname", Collation: "utf8mb4_general_ci", Loc: time.Local, MaxAllowedPacket: defaultMaxAllowedPacket, AllowNativePasswords: true, CheckConnLiveness: true},
+}, {
+	"user:password@/dbname?allowAllFiles=true&localInfileDir=%2Fvar%2Flib%2Fdata&infileAbortOnError=true&infileOpenBackoff=10ms&infileOpenRetries=3&infilePacketSize=65536&infileReadAhead=true&infileReaderTerminator=%0D%0A",
+	&Config{User: "user", Passwd: "password", Net: "tcp", Addr: "127.0.0.1:3306", DBName: "dbname", Collation: "utf8mb4_general_ci", Loc: time.UTC, MaxAllowedPacket: defaultMaxAllowedPacket, AllowNativePasswords: true, CheckConnLiveness: true, AllowAllFiles: true, LocalInfileDir: "/var/lib/data", InfileOpenRetries: 3, InfileOpenBackoff: 10 * time.Millisecond, InfilePacketSize: 65536, InfileAbortOnError: true, InfileReadAhead: true, InfileReaderTerminator: "\r\n"},
 }, {
 	"/dbname",
 	&Config{Net: "tcp", Addr: "127.0.0.1:3306", DBName: "dbname", Collation: "utf8mb4_general_ci", Loc: time.UTC, MaxAllowedPacket: defaultMaxAllowedPacket, AllowNativePasswords: true, CheckConnLiveness: true},
@@ -29,6 +29,14 @@ var (
 	ErrPktSyncMul        = errors.New("commands out of sync. Did you run multiple statements at once?")
 	ErrPktTooLarge       = errors.New("packet for query is too large. Try adjusting the 'max_allowed_packet' variable on the server")
 	ErrBusyBuffer        = errors.New("busy buffer")
+	ErrLoadCancelled     = errors.New("LOAD DATA LOCAL INFILE was cancelled")
+
+	// ErrLocalFileNotRegistered is wrapped by the error returned for a
+	// LOAD DATA LOCAL INFILE file which is not whitelisted.
+	ErrLocalFileNotRegistered = errors.New("local file is not registered")
+	// ErrLocalInfileDisabled is wrapped instead if no files are whitelisted
+	// at all and allowAllFiles is disabled.
+	ErrLocalInfileDisabled = errors.New("local files are disabled")
 
 	// errBadConnNoWrite is used for connection errors where nothing was sent to the database yet.
 	// If this happens first in a function starting a database interaction, it should be replaced by driver.ErrBadConn
@@ -9,19 +9,72 @@
 package mysql
 
 import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var (
-	fileRegister       map[string]bool
-	fileRegisterLock   sync.RWMutex
-	readerRegister     map[string]func() io.Reader
-	readerRegisterLock sync.RWMutex
-)
+// decompressors maps the codec names accepted by RegisterCompressedLocalFile
+// to a function wrapping a compressed io.Reader in a decompressor.
+var decompressors = map[string]func(io.Reader) (io.ReadCloser, error){
+	"gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"bzip2": func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	},
+}
+
+// InfileRegistry holds a file whitelist and Reader handlers for
+// "LOAD DATA LOCAL INFILE".
+// The package level functions like RegisterLocalFile and
+// RegisterReaderHandler use a global registry, which is shared by all
+// connections. A connector can be given its own registry instead, which
+// is then used exclusively by its connections:
+//
+//  registry := mysql.NewInfileRegistry()
+//  registry.RegisterReaderHandler("data", handler)
+//  cfg.InfileRegistry = registry
+//  connector, err := mysql.NewConnector(cfg)
+//  if err != nil {
+//  ...
+//  db := sql.OpenDB(connector)
+//
+// The zero value is an empty registry ready to use. An InfileRegistry is
+// safe for concurrent use.
+type InfileRegistry struct {
+	fileLock   sync.RWMutex
+	files      map[string]string // file path -> compression codec
+	openFiles  map[string]*os.File
+	pathMapper func(serverPath string) (localPath string, ok bool)
+	readerLock sync.RWMutex
+	readers    map[string]func() (io.ReadCloser, error)
+	loadLock   sync.Mutex
+	loads      map[string][]*infileLoad // active loads of Readers
+}
+
+// NewInfileRegistry returns a new, empty InfileRegistry.
+func NewInfileRegistry() *InfileRegistry {
+	return new(InfileRegistry)
+}
+
+// defaultInfileRegistry is used by connections without
+// Config.InfileRegistry.
+var defaultInfileRegistry = NewInfileRegistry()
 
 // RegisterLocalFile adds the given file to the file whitelist,
 // so that it can be used by "LOAD DATA LOCAL INFILE <filepath>".
@@ -35,21 +88,81 @@ var (
 //  ...
 //
 func RegisterLocalFile(filePath string) {
-	fileRegisterLock.Lock()
-	// lazy map init
-	if fileRegister == nil {
-		fileRegister = make(map[string]bool)
-	}
+	defaultInfileRegistry.RegisterLocalFile(filePath)
+}
+
+// RegisterCompressedLocalFile adds the given compressed file to the file
+// whitelist, so that it can be used by "LOAD DATA LOCAL INFILE <filepath>".
+// The file is decompressed with the given codec while it is sent, so the
+// server receives the uncompressed content. Supported codecs: "gzip",
+// "bzip2".
+//
+//  filePath := "/home/gopher/data.csv.gz"
+//  if err := mysql.RegisterCompressedLocalFile(filePath, "gzip"); err != nil {
+//  ...
+//  err := db.Exec("LOAD DATA LOCAL INFILE '" + filePath + "' INTO TABLE foo")
+//  if err != nil {
+//  ...
+//
+func RegisterCompressedLocalFile(filePath string, codec string) error {
+	return defaultInfileRegistry.RegisterCompressedLocalFile(filePath, codec)
+}
 
-	fileRegister[strings.Trim(filePath, `"`)] = true
-	fileRegisterLock.Unlock()
+// RegisterLocalFileReader registers an already opened file, so that it can
+// be used by "LOAD DATA LOCAL INFILE <name>". This avoids a race between
+// registering a file path and the file being renamed or removed before it
+// is loaded.
+// The file is read from the beginning on every request without changing
+// its offset. It is never closed by the driver, so the caller must close it
+// after it was deregistered with DeregisterLocalFile.
+//
+//  file, err := os.Open("/home/gopher/data.csv")
+//  ...
+//  mysql.RegisterLocalFileReader("data.csv", file)
+//  err = db.Exec("LOAD DATA LOCAL INFILE 'data.csv' INTO TABLE foo")
+//  if err != nil {
+//  ...
+//
+func RegisterLocalFileReader(name string, file *os.File) {
+	defaultInfileRegistry.RegisterLocalFileReader(name, file)
 }
 
 // DeregisterLocalFile removes the given filepath from the whitelist.
+// The whitelist is checked when the server requests a file, so loads which
+// already opened the file are not affected.
 func DeregisterLocalFile(filePath string) {
-	fileRegisterLock.Lock()
-	delete(fileRegister, strings.Trim(filePath, `"`))
-	fileRegisterLock.Unlock()
+	defaultInfileRegistry.DeregisterLocalFile(filePath)
+}
+
+// DeregisterAllLocalFiles removes all filepaths from the whitelist.
+func DeregisterAllLocalFiles() {
+	defaultInfileRegistry.DeregisterAllLocalFiles()
+}
+
+// RegisteredLocalFiles returns the sorted filepaths on the whitelist.
+func RegisteredLocalFiles() []string {
+	return defaultInfileRegistry.RegisteredLocalFiles()
+}
+
+// RegisterLocalFilePathMapper registers a function which translates the
+// path of a "LOAD DATA LOCAL INFILE <filepath>" request, as sent by the
+// server, into a local path. The mapper is called with the requested path
+// cleaned by filepath.Clean. If the mapper returns ok, the file at
+// localPath is sent without consulting the whitelist, so the mapper must
+// only return paths below a trusted directory. Local paths containing ".."
+// are rejected. Otherwise the requested path is handled as usual.
+// Only one mapper can be registered, passing nil removes it.
+//
+//  mysql.RegisterLocalFilePathMapper(func(serverPath string) (string, bool) {
+//  	rel, err := filepath.Rel("/var/data", serverPath)
+//  	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+//  		return "", false
+//  	}
+//  	return filepath.Join("/mnt/host", rel), true
+//  })
+//
+func RegisterLocalFilePathMapper(mapper func(serverPath string) (localPath string, ok bool)) {
+	defaultInfileRegistry.RegisterLocalFilePathMapper(mapper)
 }
 
 // RegisterReaderHandler registers a handler function which is used
@@ -57,6 +170,12 @@ func DeregisterLocalFile(filePath string) {
 // The Reader can be used by "LOAD DATA LOCAL INFILE Reader::<name>".
 // If the handler returns a io.ReadCloser Close() is called when the
 // request is finished.
+// If the Reader implements Size() int64, like bytes.Reader, the first packet
+// buffer is not allocated larger than its size. The size is only a hint, the
+// buffer is grown if the Reader provides more data and it is read completely.
+// Requests for names which are not registered and contain a path separator
+// or ".." are rejected with a distinct error, since they hint at a
+// misbehaving server.
 //
 //  mysql.RegisterReaderHandler("data", func() io.Reader {
 //  	var csvReader io.Reader // Some Reader that returns CSV data
@@ -68,100 +187,1548 @@ func DeregisterLocalFile(filePath string) {
 //  ...
 //
 func RegisterReaderHandler(name string, handler func() io.Reader) {
-	readerRegisterLock.Lock()
-	// lazy map init
-	if readerRegister == nil {
-		readerRegister = make(map[string]func() io.Reader)
-	}
+	defaultInfileRegistry.RegisterReaderHandler(name, handler)
+}
 
-	readerRegister[name] = handler
-	readerRegisterLock.Unlock()
+// RegisterReadCloserHandler registers a handler function which is used
+// to receive a io.ReadCloser.
+// The ReadCloser can be used by "LOAD DATA LOCAL INFILE Reader::<name>".
+// Unlike RegisterReaderHandler, the handler may fail before any data is
+// sent by returning an error, and Close() is always called when the
+// request is finished.
+//
+//  mysql.RegisterReadCloserHandler("data", func() (io.ReadCloser, error) {
+//  	resp, err := http.Get("https://example.com/data.csv")
+//  	if err != nil {
+//  		return nil, err
+//  	}
+//  	return resp.Body, nil
+//  })
+//  err := db.Exec("LOAD DATA LOCAL INFILE 'Reader::data' INTO TABLE foo")
+//  if err != nil {
+//  ...
+//
+func RegisterReadCloserHandler(name string, handler func() (io.ReadCloser, error)) {
+	defaultInfileRegistry.RegisterReadCloserHandler(name, handler)
+}
+
+// RegisterCompressedReaderHandler registers a handler function like
+// RegisterReaderHandler, but the returned io.Reader provides compressed
+// data. It is decompressed with the given codec while it is sent, so the
+// server receives the uncompressed content. Supported codecs: "gzip",
+// "bzip2".
+// If the Reader is a io.ReadCloser, Close() is called after the
+// decompressor was closed.
+//
+//  err := mysql.RegisterCompressedReaderHandler("data", "gzip", func() io.Reader {
+//  	return gzippedCSV
+//  })
+//  if err != nil {
+//  ...
+//  err = db.Exec("LOAD DATA LOCAL INFILE 'Reader::data' INTO TABLE foo")
+//  if err != nil {
+//  ...
+//
+func RegisterCompressedReaderHandler(name string, codec string, handler func() io.Reader) error {
+	return defaultInfileRegistry.RegisterCompressedReaderHandler(name, codec, handler)
+}
+
+// RegisterHTTPReaderHandler registers a Reader handler which streams the
+// body of a GET request to the given URL. The request is sent with client,
+// or http.DefaultClient if it is nil, each time the Reader is requested.
+// Responses with a status other than 2xx fail the load.
+//
+//  mysql.RegisterHTTPReaderHandler("export", "https://example.com/export.csv", nil)
+//  err := db.Exec("LOAD DATA LOCAL INFILE 'Reader::export' INTO TABLE foo")
+//  if err != nil {
+//  ...
+//
+func RegisterHTTPReaderHandler(name string, url string, client *http.Client) {
+	defaultInfileRegistry.RegisterHTTPReaderHandler(name, url, client)
+}
+
+// RegisterSpillingReaderHandler registers a handler function like
+// RegisterReaderHandler, but the returned io.Reader is first copied into a
+// temporary file in tmpDir (os.TempDir() if empty). The Reader is closed as
+// soon as it was drained, before any data is sent to the server, so
+// resources like a database cursor are not held during a slow load.
+// The temporary file is not synced and is removed after the load.
+func RegisterSpillingReaderHandler(name string, handler func() io.Reader, tmpDir string) {
+	defaultInfileRegistry.RegisterSpillingReaderHandler(name, handler, tmpDir)
+}
+
+// ResumeOptions configures how a Reader registered with
+// RegisterResumableReaderHandler retries a broken source.
+type ResumeOptions struct {
+	MaxRetries int                  // Max retries of reopening the source per load
+	Backoff    time.Duration        // Wait before the first retry, doubled for every further retry (default: 100ms)
+	Permanent  func(err error) bool // Reports errors which are not retried, e.g. of a missing object
+}
+
+// RegisterResumableReaderHandler registers a Reader handler for sources
+// like object stores, whose streams might break on network errors.
+// factory opens the source at the given byte offset, so it must support
+// range or offset reads. If reading or reopening fails with an error other
+// than io.EOF, the source is reopened after the bytes already read and
+// reading resumes. Retries wait for opts.Backoff, which is doubled for
+// every further retry, and a load fails after opts.MaxRetries retries or
+// on the first error opts.Permanent reports. Cancelling the context of the
+// query or calling CancelReader stops waiting for a retry.
+//
+//  mysql.RegisterResumableReaderHandler("s3", func(offset int64) (io.ReadCloser, error) {
+//  	return openObject(bucket, key, offset) // e.g. a GET with a Range header
+//  }, mysql.ResumeOptions{
+//  	MaxRetries: 3,
+//  	Permanent:  isNotFound,
+//  })
+//  err := db.Exec("LOAD DATA LOCAL INFILE 'Reader::s3' INTO TABLE foo")
+//  if err != nil {
+//  ...
+//
+func RegisterResumableReaderHandler(name string, factory func(offset int64) (io.ReadCloser, error), opts ResumeOptions) {
+	defaultInfileRegistry.RegisterResumableReaderHandler(name, factory, opts)
+}
+
+// RegisterMultiFileReader registers a Reader handler which concatenates
+// the given files, so that a single "LOAD DATA LOCAL INFILE Reader::<name>"
+// loads all of them. A newline is inserted between two files if the former
+// does not end with one.
+// The files are opened one after another when they are read and closed as
+// soon as they are exhausted.
+//
+//  mysql.RegisterMultiFileReader("shards", []string{
+//  	"/home/gopher/shard1.csv",
+//  	"/home/gopher/shard2.csv",
+//  })
+//  err := db.Exec("LOAD DATA LOCAL INFILE 'Reader::shards' INTO TABLE foo")
+//  if err != nil {
+//  ...
+//
+func RegisterMultiFileReader(name string, paths []string) {
+	defaultInfileRegistry.RegisterMultiFileReader(name, paths)
+}
+
+// RegisterMultiFileReaderTerminator works like RegisterMultiFileReader, but
+// inserts the given line terminator between two files instead of a newline,
+// e.g. "\r\n" for "LINES TERMINATED BY '\r\n'".
+// Only the missing part of the terminator is inserted, so a file ending
+// with "\r" is followed by "\n" only. For the terminator "\r\n" a file
+// ending with "\n" is considered finished as well, so files with "\n" and
+// "\r\n" line endings can be mixed without inserting empty lines.
+func RegisterMultiFileReaderTerminator(name string, paths []string, terminator string) {
+	defaultInfileRegistry.RegisterMultiFileReaderTerminator(name, paths, terminator)
+}
+
+// CheckReaderHandler checks the Reader handler with the given name without a
+// server: it calls the handler, reads the first bytes of the returned
+// Reader and closes it. It returns the error a load would fail with, if any.
+// The handler must return a new Reader on every call, otherwise the bytes
+// read are missing in the next load.
+//
+//  if err := mysql.CheckReaderHandler("data"); err != nil {
+//  	log.Fatal(err)
+//  }
+//
+func CheckReaderHandler(name string) error {
+	return defaultInfileRegistry.CheckReaderHandler(name)
 }
 
 // DeregisterReaderHandler removes the ReaderHandler function with
 // the given name from the registry.
 func DeregisterReaderHandler(name string) {
-	readerRegisterLock.Lock()
-	delete(readerRegister, name)
-	readerRegisterLock.Unlock()
+	defaultInfileRegistry.DeregisterReaderHandler(name)
+}
+
+// DeregisterAllReaderHandlers removes all ReaderHandler functions from
+// the registry.
+func DeregisterAllReaderHandlers() {
+	defaultInfileRegistry.DeregisterAllReaderHandlers()
+}
+
+// RegisteredReaderHandlers returns the sorted names of all registered
+// ReaderHandler functions.
+func RegisteredReaderHandlers() []string {
+	return defaultInfileRegistry.RegisteredReaderHandlers()
+}
+
+// CancelReader aborts all active loads of the Reader with the given name.
+// The loads stop sending data before the next packet and fail with
+// ErrLoadCancelled. It is a no-op if no load of the Reader is active.
+//
+//  go func() {
+//  	<-downstreamFailed
+//  	mysql.CancelReader("data")
+//  }()
+//  _, err := db.Exec("LOAD DATA LOCAL INFILE 'Reader::data' INTO TABLE foo")
+//  if err == mysql.ErrLoadCancelled {
+//  ...
+//
+func CancelReader(name string) {
+	defaultInfileRegistry.CancelReader(name)
+}
+
+// RegisterLocalFile adds the given file to the registry's file whitelist.
+// See the package level RegisterLocalFile for details.
+func (r *InfileRegistry) RegisterLocalFile(filePath string) {
+	r.registerLocalFile(filePath, "")
+}
+
+// RegisterCompressedLocalFile adds the given compressed file to the
+// registry's file whitelist.
+// See the package level RegisterCompressedLocalFile for details.
+func (r *InfileRegistry) RegisterCompressedLocalFile(filePath string, codec string) error {
+	if _, ok := decompressors[codec]; !ok {
+		return fmt.Errorf("unknown compression codec '%s'", codec)
+	}
+	r.registerLocalFile(filePath, codec)
+	return nil
+}
+
+func (r *InfileRegistry) registerLocalFile(filePath string, codec string) {
+	r.fileLock.Lock()
+	if r.files == nil {
+		r.files = make(map[string]string)
+	}
+	r.files[strings.Trim(filePath, `"`)] = codec
+	r.fileLock.Unlock()
+}
+
+// RegisterLocalFileReader registers an already opened file in the registry.
+// See the package level RegisterLocalFileReader for details.
+func (r *InfileRegistry) RegisterLocalFileReader(name string, file *os.File) {
+	r.fileLock.Lock()
+	if r.openFiles == nil {
+		r.openFiles = make(map[string]*os.File)
+	}
+	r.openFiles[strings.Trim(name, `"`)] = file
+	r.fileLock.Unlock()
+}
+
+// DeregisterLocalFile removes the given filepath from the registry's
+// whitelist.
+func (r *InfileRegistry) DeregisterLocalFile(filePath string) {
+	filePath = strings.Trim(filePath, `"`)
+	r.fileLock.Lock()
+	delete(r.files, filePath)
+	delete(r.openFiles, filePath)
+	r.fileLock.Unlock()
+}
+
+// DeregisterAllLocalFiles removes all filepaths from the registry's
+// whitelist.
+func (r *InfileRegistry) DeregisterAllLocalFiles() {
+	r.fileLock.Lock()
+	r.files = nil
+	r.openFiles = nil
+	r.fileLock.Unlock()
+}
+
+// RegisteredLocalFiles returns the sorted filepaths on the registry's
+// whitelist.
+func (r *InfileRegistry) RegisteredLocalFiles() []string {
+	r.fileLock.RLock()
+	paths := make([]string, 0, len(r.files)+len(r.openFiles))
+	for path := range r.files {
+		paths = append(paths, path)
+	}
+	for name := range r.openFiles {
+		if _, ok := r.files[name]; !ok {
+			paths = append(paths, name)
+		}
+	}
+	r.fileLock.RUnlock()
+
+	sort.Strings(paths)
+	return paths
+}
+
+// RegisterLocalFilePathMapper registers a function which translates
+// requested file paths into local paths in the registry.
+// See the package level RegisterLocalFilePathMapper for details.
+func (r *InfileRegistry) RegisterLocalFilePathMapper(mapper func(serverPath string) (localPath string, ok bool)) {
+	r.fileLock.Lock()
+	r.pathMapper = mapper
+	r.fileLock.Unlock()
+}
+
+// mapLocalFile translates filePath with the registered path mapper.
+func (r *InfileRegistry) mapLocalFile(filePath string) (localPath string, ok bool) {
+	r.fileLock.RLock()
+	mapper := r.pathMapper
+	r.fileLock.RUnlock()
+
+	if mapper == nil {
+		return "", false
+	}
+	return mapper(filepath.Clean(filePath))
+}
+
+// containsDotDot reports whether path has a ".." element.
+func containsDotDot(path string) bool {
+	isSeparator := func(r rune) bool { return r == '/' || r == filepath.Separator }
+	for _, elem := range strings.FieldsFunc(path, isSeparator) {
+		if elem == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// openLocalFile returns the opened file registered with the given name.
+func (r *InfileRegistry) openLocalFile(name string) *os.File {
+	r.fileLock.RLock()
+	file := r.openFiles[name]
+	r.fileLock.RUnlock()
+	return file
+}
+
+// localFile returns whether the given file is whitelisted and the codec
+// it was registered with.
+func (r *InfileRegistry) localFile(filePath string) (codec string, ok bool) {
+	r.fileLock.RLock()
+	codec, ok = r.files[filePath]
+	r.fileLock.RUnlock()
+	return
+}
+
+// hasLocalFiles reports whether any local files can be allowed by the
+// registry.
+func (r *InfileRegistry) hasLocalFiles() bool {
+	r.fileLock.RLock()
+	has := len(r.files) > 0 || len(r.openFiles) > 0 || r.pathMapper != nil
+	r.fileLock.RUnlock()
+	return has
+}
+
+// RegisterReaderHandler registers a handler function which is used to
+// receive a io.Reader in the registry.
+// See the package level RegisterReaderHandler for details.
+func (r *InfileRegistry) RegisterReaderHandler(name string, handler func() io.Reader) {
+	r.RegisterReadCloserHandler(name, readCloserHandler(handler))
+}
+
+// readCloserHandler converts a ReaderHandler function into a function
+// returning a io.ReadCloser.
+func readCloserHandler(handler func() io.Reader) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		rdr := handler()
+		if rdr == nil {
+			return nil, nil
+		}
+		if rc, ok := rdr.(io.ReadCloser); ok {
+			return rc, nil
+		}
+		return nopCloser{rdr}, nil
+	}
+}
+
+// nopCloser is like ioutil.NopCloser, but keeps the Reader accessible for
+// readerSize.
+type nopCloser struct {
+	io.Reader
+}
+
+func (nopCloser) Close() error { return nil }
+
+// readerSize returns the size hint of a Reader implementing
+// Size() int64, like bytes.Reader and strings.Reader.
+func readerSize(rdr io.Reader) (size int64, ok bool) {
+	if nc, isNop := rdr.(nopCloser); isNop {
+		rdr = nc.Reader
+	}
+	if sizer, isSizer := rdr.(interface{ Size() int64 }); isSizer {
+		size, ok = sizer.Size(), true
+	}
+	return
+}
+
+// RegisterCompressedReaderHandler registers a handler function which is
+// used to receive a io.Reader of compressed data in the registry.
+// See the package level RegisterCompressedReaderHandler for details.
+func (r *InfileRegistry) RegisterCompressedReaderHandler(name string, codec string, handler func() io.Reader) error {
+	decompress, ok := decompressors[codec]
+	if !ok {
+		return fmt.Errorf("unknown compression codec '%s'", codec)
+	}
+
+	open := readCloserHandler(handler)
+	r.RegisterReadCloserHandler(name, func() (io.ReadCloser, error) {
+		rc, err := open()
+		if rc == nil || err != nil {
+			return rc, err
+		}
+		dc, err := decompress(rc)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		return &decompressReader{ReadCloser: dc, src: rc}, nil
+	})
+	return nil
+}
+
+// RegisterReadCloserHandler registers a handler function which is used to
+// receive a io.ReadCloser in the registry.
+// See the package level RegisterReadCloserHandler for details.
+func (r *InfileRegistry) RegisterReadCloserHandler(name string, handler func() (io.ReadCloser, error)) {
+	r.readerLock.Lock()
+	if r.readers == nil {
+		r.readers = make(map[string]func() (io.ReadCloser, error))
+	}
+	r.readers[name] = handler
+	r.readerLock.Unlock()
+}
+
+// RegisterHTTPReaderHandler registers a Reader handler which streams the
+// body of a GET request to the given URL in the registry.
+// See the package level RegisterHTTPReaderHandler for details.
+func (r *InfileRegistry) RegisterHTTPReaderHandler(name string, url string, client *http.Client) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	r.RegisterReadCloserHandler(name, func() (io.ReadCloser, error) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			resp.Body.Close()
+			return nil, fmt.Errorf("Reader '%s': GET %s returned %s", name, url, resp.Status)
+		}
+		return resp.Body, nil
+	})
+}
+
+// RegisterSpillingReaderHandler registers a handler function whose Reader
+// is copied into a temporary file before it is sent in the registry.
+// See the package level RegisterSpillingReaderHandler for details.
+func (r *InfileRegistry) RegisterSpillingReaderHandler(name string, handler func() io.Reader, tmpDir string) {
+	open := readCloserHandler(handler)
+	r.RegisterReadCloserHandler(name, func() (io.ReadCloser, error) {
+		rc, err := open()
+		if rc == nil || err != nil {
+			return rc, err
+		}
+		return spill(rc, tmpDir)
+	})
+}
+
+// spill copies rc into a temporary file in dir and closes it. The returned
+// file removes itself when it is closed.
+func spill(rc io.ReadCloser, dir string) (spilled io.ReadCloser, err error) {
+	var tmp *tempFile
+	success := false
+	defer func() {
+		// also clean up if rc panicked
+		if !success || err != nil {
+			spilled = nil
+			if tmp != nil {
+				tmp.Close()
+			}
+		}
+	}()
+	defer deferredClose(&err, nil, rc)
+
+	file, err := ioutil.TempFile(dir, "mysql-infile-")
+	if err != nil {
+		return nil, err
+	}
+	tmp = &tempFile{file}
+	if _, err = io.Copy(file, rc); err != nil {
+		return nil, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	success = true
+	return tmp, nil
+}
+
+// tempFile is a file which is removed when it is closed.
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	if rmErr := os.Remove(f.Name()); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// RegisterResumableReaderHandler registers a Reader handler which reopens
+// its source on read errors in the registry.
+// See the package level RegisterResumableReaderHandler for details.
+func (r *InfileRegistry) RegisterResumableReaderHandler(name string, factory func(offset int64) (io.ReadCloser, error), opts ResumeOptions) {
+	if opts.Backoff <= 0 {
+		opts.Backoff = 100 * time.Millisecond
+	}
+	r.RegisterReadCloserHandler(name, func() (io.ReadCloser, error) {
+		rc, err := factory(0)
+		if err != nil {
+			return nil, err
+		}
+		return &resumableReader{factory: factory, opts: opts, backoff: opts.Backoff, rc: rc}, nil
+	})
+}
+
+// RegisterMultiFileReader registers a Reader handler which concatenates
+// the given files in the registry.
+// See the package level RegisterMultiFileReader for details.
+func (r *InfileRegistry) RegisterMultiFileReader(name string, paths []string) {
+	r.RegisterMultiFileReaderTerminator(name, paths, "\n")
+}
+
+// RegisterMultiFileReaderTerminator registers a Reader handler which
+// concatenates the given files using a custom line terminator in the
+// registry.
+// See the package level RegisterMultiFileReaderTerminator for details.
+func (r *InfileRegistry) RegisterMultiFileReaderTerminator(name string, paths []string, terminator string) {
+	paths = append([]string(nil), paths...)
+	r.RegisterReadCloserHandler(name, func() (io.ReadCloser, error) {
+		return &multiFileReader{paths: paths, terminator: terminator}, nil
+	})
+}
+
+// CheckReaderHandler checks the Reader handler with the given name in the
+// registry without a server.
+// See the package level CheckReaderHandler for details.
+func (r *InfileRegistry) CheckReaderHandler(name string) (err error) {
+	handler, ok := r.readerHandler(name)
+	if !ok {
+		return fmt.Errorf("Reader '%s' is not registered", name)
+	}
+	rc, err := callReaderHandler(name, handler)
+	if rc != nil {
+		defer deferredClose(&err, nil, rc)
+	}
+	if err != nil {
+		return err
+	}
+	if rc == nil {
+		return fmt.Errorf("Reader '%s' is <nil>", name)
+	}
+
+	var buf [512]byte
+	rdr := &recoverReader{name: name, rdr: rc}
+	if _, err = rdr.Read(buf[:]); err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// DeregisterReaderHandler removes the ReaderHandler function with
+// the given name from the registry.
+func (r *InfileRegistry) DeregisterReaderHandler(name string) {
+	r.readerLock.Lock()
+	delete(r.readers, name)
+	r.readerLock.Unlock()
+}
+
+// DeregisterAllReaderHandlers removes all ReaderHandler functions from
+// the registry.
+func (r *InfileRegistry) DeregisterAllReaderHandlers() {
+	r.readerLock.Lock()
+	r.readers = nil
+	r.readerLock.Unlock()
+}
+
+// RegisteredReaderHandlers returns the sorted names of all ReaderHandler
+// functions in the registry.
+func (r *InfileRegistry) RegisteredReaderHandlers() []string {
+	r.readerLock.RLock()
+	names := make([]string, 0, len(r.readers))
+	for name := range r.readers {
+		names = append(names, name)
+	}
+	r.readerLock.RUnlock()
+
+	sort.Strings(names)
+	return names
+}
+
+// invalidReaderName reports whether name contains a path separator or is
+// "..". Such names are never requested by a well-behaved server, unless
+// they are registered.
+func invalidReaderName(name string) bool {
+	return strings.ContainsAny(name, `/\`) || name == ".."
+}
+
+// readerHandler returns the ReaderHandler function with the given name.
+func (r *InfileRegistry) readerHandler(name string) (handler func() (io.ReadCloser, error), ok bool) {
+	r.readerLock.RLock()
+	handler, ok = r.readers[name]
+	r.readerLock.RUnlock()
+	return
+}
+
+// CancelReader aborts all active loads of the Reader with the given name.
+// See the package level CancelReader for details.
+func (r *InfileRegistry) CancelReader(name string) {
+	r.loadLock.Lock()
+	for _, load := range r.loads[name] {
+		load.cancel()
+	}
+	r.loadLock.Unlock()
+}
+
+// startLoad registers an active load of the Reader with the given name.
+func (r *InfileRegistry) startLoad(name string) *infileLoad {
+	load := &infileLoad{cancelled: make(chan struct{})}
+	r.loadLock.Lock()
+	if r.loads == nil {
+		r.loads = make(map[string][]*infileLoad)
+	}
+	r.loads[name] = append(r.loads[name], load)
+	r.loadLock.Unlock()
+	return load
+}
+
+// endLoad removes a load registered by startLoad.
+func (r *InfileRegistry) endLoad(name string, load *infileLoad) {
+	r.loadLock.Lock()
+	loads := r.loads[name]
+	for i := range loads {
+		if loads[i] == load {
+			loads = append(loads[:i], loads[i+1:]...)
+			break
+		}
+	}
+	if len(loads) > 0 {
+		r.loads[name] = loads
+	} else {
+		delete(r.loads, name)
+	}
+	r.loadLock.Unlock()
+}
+
+// infileLoad is an active load of a Reader, which can be cancelled.
+type infileLoad struct {
+	once      sync.Once
+	cancelled chan struct{}
+}
+
+func (l *infileLoad) cancel() {
+	l.once.Do(func() { close(l.cancelled) })
+}
+
+// decompressReader reads from a decompressor and closes the decompressor
+// and then the compressed source.
+type decompressReader struct {
+	io.ReadCloser
+	src io.Closer
+}
+
+func (r *decompressReader) Close() error {
+	err := r.ReadCloser.Close()
+	if srcErr := r.src.Close(); err == nil {
+		err = srcErr
+	}
+	return err
+}
+
+// multiFileReader reads the files in paths one after another.
+type multiFileReader struct {
+	paths      []string
+	terminator string   // line terminator inserted between files
+	file       *os.File // currently read file
+	tail       []byte   // last bytes read from file
+	pending    string   // bytes to insert before the next file
+}
+
+func (r *multiFileReader) Read(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if r.file == nil {
+			if r.pending != "" && len(r.paths) > 0 {
+				n = copy(p, r.pending)
+				r.pending = r.pending[n:]
+				return n, nil
+			}
+			if len(r.paths) == 0 {
+				return 0, io.EOF
+			}
+			if r.file, err = os.Open(r.paths[0]); err != nil {
+				r.file = nil
+				return 0, err
+			}
+			r.paths = r.paths[1:]
+			r.tail = r.tail[:0]
+		}
+
+		n, err = r.file.Read(p)
+		r.appendTail(p[:n])
+		if err == io.EOF {
+			err = r.file.Close()
+			r.file = nil
+			r.pending = r.missingTerminator()
+			if n == 0 && err == nil {
+				continue
+			}
+		}
+		return n, err
+	}
+	return 0, nil
+}
+
+// appendTail keeps the last len(r.terminator) bytes read from the file.
+func (r *multiFileReader) appendTail(b []byte) {
+	size := len(r.terminator)
+	if len(b) >= size {
+		r.tail = append(r.tail[:0], b[len(b)-size:]...)
+		return
+	}
+	r.tail = append(r.tail, b...)
+	if len(r.tail) > size {
+		r.tail = r.tail[:copy(r.tail, r.tail[len(r.tail)-size:])]
+	}
+}
+
+// missingTerminator returns the part of the line terminator which is
+// missing at the end of the file, e.g. "\n" if a file ends with "\r" and
+// the terminator is "\r\n".
+func (r *multiFileReader) missingTerminator() string {
+	if len(r.tail) == 0 {
+		// empty file
+		return ""
+	}
+	if r.terminator == "\r\n" && bytes.HasSuffix(r.tail, []byte("\n")) {
+		// a file with "\n" line endings among "\r\n" files
+		return ""
+	}
+	for k := len(r.terminator); k > 0; k-- {
+		if bytes.HasSuffix(r.tail, []byte(r.terminator[:k])) {
+			return r.terminator[k:]
+		}
+	}
+	return r.terminator
+}
+
+func (r *multiFileReader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// resumableReader reopens its source with factory after read errors.
+type resumableReader struct {
+	factory   func(offset int64) (io.ReadCloser, error)
+	opts      ResumeOptions
+	retries   int             // retries of this load
+	backoff   time.Duration   // wait before the next retry
+	rc        io.ReadCloser   // current source, nil after an error
+	offset    int64           // bytes read so far
+	closech   <-chan struct{} // closed with the connection, interrupts the backoff
+	cancelled <-chan struct{} // closed by CancelReader, interrupts the backoff
 }
 
-func deferredClose(err *error, closer io.Closer) {
+// retry waits for the backoff if err can be retried and returns nil then.
+// Otherwise it returns err, or ErrLoadCancelled if the load was cancelled
+// while waiting.
+func (r *resumableReader) retry(err error) error {
+	if r.retries >= r.opts.MaxRetries || (r.opts.Permanent != nil && r.opts.Permanent(err)) {
+		return err
+	}
+	r.retries++
+	if !waitBackoff(r.backoff, r.closech, r.cancelled) {
+		select {
+		case <-r.cancelled:
+			return ErrLoadCancelled
+		default:
+			return err
+		}
+	}
+	r.backoff *= 2
+	return nil
+}
+
+func (r *resumableReader) Read(p []byte) (int, error) {
+	for {
+		if r.rc == nil {
+			rc, err := r.factory(r.offset)
+			if err != nil {
+				if err = r.retry(err); err != nil {
+					return 0, err
+				}
+				continue
+			}
+			r.rc = rc
+		}
+
+		n, err := r.rc.Read(p)
+		r.offset += int64(n)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+
+		// resume after the bytes read so far
+		r.rc.Close()
+		r.rc = nil
+		if err = r.retry(err); err != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// waitBackoff waits for d and reports whether it did so without closech or
+// cancelled being closed before. Nil channels are never closed.
+func waitBackoff(d time.Duration, closech, cancelled <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-closech:
+	case <-cancelled:
+	}
+	return false
+}
+
+func (r *resumableReader) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+	return r.rc.Close()
+}
+
+// infileError is an error message wrapping one of the exported errors, so
+// errors.Is can be used on Go 1.13+.
+type infileError struct {
+	msg string
+	err error
+}
+
+func (e *infileError) Error() string {
+	return e.msg
+}
+
+func (e *infileError) Unwrap() error {
+	return e.err
+}
+
+// readerPanicError is returned if a registered Reader handler or the Reader
+// it returned panicked.
+type readerPanicError struct {
+	name  string
+	value interface{}
+}
+
+func (e *readerPanicError) Error() string {
+	return fmt.Sprintf("Reader '%s' panicked: %v", e.name, e.value)
+}
+
+// callReaderHandler calls handler and converts a panic into an error.
+func callReaderHandler(name string, handler func() (io.ReadCloser, error)) (rc io.ReadCloser, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			rc, err = nil, &readerPanicError{name: name, value: v}
+		}
+	}()
+	return handler()
+}
+
+// recoverReader converts panics of the wrapped Reader into errors.
+type recoverReader struct {
+	name string
+	rdr  io.Reader
+}
+
+func (r *recoverReader) Read(p []byte) (n int, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			n, err = 0, &readerPanicError{name: r.name, value: v}
+		}
+	}()
+	return r.rdr.Read(p)
+}
+
+// readAheadReader reads the next chunk of a Reader in a separate goroutine,
+// so that reading it overlaps with sending the current chunk.
+type readAheadReader struct {
+	chunks chan *readAheadChunk // chunks read by the goroutine
+	free   chan *readAheadChunk // chunks which can be reused
+	done   chan struct{}        // closed to stop the goroutine
+	cur    *readAheadChunk
+	off    int
+	err    error
+}
+
+type readAheadChunk struct {
+	buf []byte
+	n   int
+	err error
+}
+
+func newReadAheadReader(rdr io.Reader, size int) *readAheadReader {
+	r := &readAheadReader{
+		chunks: make(chan *readAheadChunk, 2),
+		free:   make(chan *readAheadChunk, 2),
+		done:   make(chan struct{}),
+	}
+	for i := 0; i < 2; i++ {
+		r.free <- &readAheadChunk{buf: make([]byte, size)}
+	}
+	go r.readChunks(rdr)
+	return r
+}
+
+func (r *readAheadReader) readChunks(rdr io.Reader) {
+	defer close(r.chunks)
+	for {
+		select {
+		case <-r.done:
+			return
+		default:
+		}
+
+		var c *readAheadChunk
+		select {
+		case c = <-r.free:
+		case <-r.done:
+			return
+		}
+
+		c.n, c.err = rdr.Read(c.buf)
+		r.chunks <- c // never blocks, the channel can hold all chunks
+		if c.err != nil {
+			return
+		}
+	}
+}
+
+func (r *readAheadReader) Read(p []byte) (int, error) {
+	for r.err == nil {
+		if r.cur == nil {
+			c, ok := <-r.chunks
+			if !ok {
+				r.err = io.EOF
+				break
+			}
+			r.cur, r.off = c, 0
+		}
+
+		if r.off < r.cur.n {
+			n := copy(p, r.cur.buf[r.off:r.cur.n])
+			r.off += n
+			return n, nil
+		}
+
+		// current chunk is exhausted
+		if r.cur.err != nil {
+			r.err = r.cur.err
+			break
+		}
+		r.free <- r.cur
+		r.cur = nil
+	}
+	return 0, r.err
+}
+
+// Close stops the goroutine. It doesn't wait for a Read of the underlying
+// Reader in progress, which might stall, e.g. on a network source. Close
+// the underlying Reader afterwards to unblock it and then wait for the
+// goroutine with wait.
+func (r *readAheadReader) Close() error {
+	close(r.done)
+	return nil
+}
+
+// wait waits until the goroutine returned, so that the underlying Reader
+// is no longer used afterwards.
+func (r *readAheadReader) wait() {
+	for range r.chunks {
+	}
+}
+
+// fillPacket reads from rdr until buf is full or an error occurs.
+// Unlike io.ReadFull it returns the error of the Reader unchanged, so a
+// truncated compressed stream is not mistaken for the end of the data.
+func fillPacket(rdr io.Reader, buf []byte) (n int, err error) {
+	for n < len(buf) && err == nil {
+		var nn int
+		nn, err = rdr.Read(buf[n:])
+		n += nn
+	}
+	return
+}
+
+// deferredClose closes closer and stores the error of Close in err.
+// If err already holds an error, it is returned unchanged, so callers can
+// still compare it with sentinel errors like ErrInvalidConn. The error of
+// Close is logged then and stored in dropped, if it is not nil and doesn't
+// hold an error yet.
+func deferredClose(err *error, dropped *error, closer io.Closer) {
 	closeErr := closer.Close()
-	if *err == nil {
+	switch {
+	case closeErr == nil:
+	case *err == nil:
 		*err = closeErr
+	default:
+		errLog.Print("close after error: ", closeErr)
+		if dropped != nil && *dropped == nil {
+			*dropped = closeErr
+		}
+	}
+}
+
+// InfileStats is a snapshot of the LOAD DATA LOCAL INFILE counters of the
+// driver, summed up over all connections.
+type InfileStats struct {
+	Requests  uint64 // LOAD DATA LOCAL INFILE requests handled
+	Rejected  uint64 // requests for files or Readers which are not allowed
+	Packets   uint64 // data packets sent, excluding the terminating packets
+	BytesSent uint64 // data bytes sent
+}
+
+var (
+	infileRequests  uint64
+	infileRejected  uint64
+	infilePackets   uint64
+	infileBytesSent uint64
+)
+
+// Stats returns a snapshot of the LOAD DATA LOCAL INFILE counters.
+// A spike of rejected requests might indicate a malicious server.
+func Stats() InfileStats {
+	return InfileStats{
+		Requests:  atomic.LoadUint64(&infileRequests),
+		Rejected:  atomic.LoadUint64(&infileRejected),
+		Packets:   atomic.LoadUint64(&infilePackets),
+		BytesSent: atomic.LoadUint64(&infileBytesSent),
+	}
+}
+
+// localInfileDirPath resolves all symlinks in filePath and checks that the
+// result is located inside dir. It returns the resolved path and whether
+// it is inside dir.
+func localInfileDirPath(dir, filePath string) (string, bool, error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err == nil {
+		root, err = filepath.Abs(root)
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	path, err := filepath.EvalSymlinks(filepath.Clean(filePath))
+	if err == nil {
+		path, err = filepath.Abs(path)
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false, nil
+	}
+	return path, true, nil
+}
+
+// infileRegistry returns the InfileRegistry used by the connection.
+func (mc *mysqlConn) infileRegistry() *InfileRegistry {
+	if mc.cfg.InfileRegistry != nil {
+		return mc.cfg.InfileRegistry
+	}
+	return defaultInfileRegistry
+}
+
+// LocalInfileSupported reports whether the server advertised the
+// CLIENT_LOCAL_FILES capability in its handshake. If it did not,
+// "LOAD DATA LOCAL INFILE" fails and an application can fall back to
+// INSERT statements instead. A server advertising the capability might
+// still reject a load, e.g. if local_infile was disabled after connecting.
+// The method is available through sql.Conn.Raw (Go 1.13+):
+//
+//  err := conn.Raw(func(driverConn interface{}) error {
+//  	c := driverConn.(interface{ LocalInfileSupported() bool })
+//  	supported = c.LocalInfileSupported()
+//  	return nil
+//  })
+//
+func (mc *mysqlConn) LocalInfileSupported() bool {
+	return mc.flags&clientLocalFiles != 0
+}
+
+// InfileAuditEvent describes a LOAD DATA LOCAL INFILE request served by the
+// driver. It is passed to Config.InfileAuditLog.
+type InfileAuditEvent struct {
+	Name      string // file or Reader name requested by the server
+	Path      string // local path of a file after mapping and LocalInfileDir, empty for Readers
+	Allowed   bool   // false if the request was rejected
+	BytesSent int64  // data bytes sent to the server
+	Err       error  // error of the request, if any
+	CloseErr  error  // error of closing the file or Reader, if Err is another error
+}
+
+// LoadDataInfo holds the counters the server reports after a LOAD DATA
+// statement.
+type LoadDataInfo struct {
+	Info     string // raw info string, e.g. "Records: 3  Deleted: 0  Skipped: 0  Warnings: 0"
+	Records  int64  // records read
+	Deleted  int64  // records replaced with REPLACE
+	Skipped  int64  // records skipped as duplicates with IGNORE
+	Warnings int64  // warnings raised
+}
+
+// parseLoadDataInfo parses the info string of the OK packet of a LOAD DATA
+// statement. Unknown keys are ignored.
+func parseLoadDataInfo(info string) LoadDataInfo {
+	ldi := LoadDataInfo{Info: info}
+	fields := strings.Fields(info)
+	for i := 0; i+1 < len(fields); i += 2 {
+		v, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[i] {
+		case "Records:":
+			ldi.Records = v
+		case "Deleted:":
+			ldi.Deleted = v
+		case "Skipped:":
+			ldi.Skipped = v
+		case "Warnings:":
+			ldi.Warnings = v
+		}
+	}
+	return ldi
+}
+
+// readInfileResultOK reads the result of a LOAD DATA LOCAL INFILE request
+// and passes its info to Config.InfileInfo.
+func (mc *mysqlConn) readInfileResultOK(name string) error {
+	if mc.cfg.InfileInfo == nil {
+		return mc.readResultOK()
+	}
+
+	data, err := mc.readPacket()
+	if err != nil {
+		return err
+	}
+	if data[0] != iOK {
+		return mc.handleErrorPacket(data)
+	}
+	if err = mc.handleOkPacket(data); err == nil {
+		mc.cfg.InfileInfo(name, parseLoadDataInfo(okPacketInfo(data)))
+	}
+	return err
+}
+
+// openInfile opens a file, retrying with Config.InfileOpenBackoff up to
+// Config.InfileOpenRetries times while it does not exist. With
+// Config.LocalInfileDir the file is resolved and checked on every attempt.
+// It returns the resolved path and whether the file is inside of
+// Config.LocalInfileDir.
+func (mc *mysqlConn) openInfile(path string) (file *os.File, resolved string, inside bool, err error) {
+	backoff := mc.cfg.InfileOpenBackoff
+	for retries := 0; ; retries++ {
+		file, resolved, inside, err = mc.openInfileOnce(path)
+		if err == nil || !os.IsNotExist(err) || retries >= mc.cfg.InfileOpenRetries {
+			return
+		}
+		if !waitBackoff(backoff, mc.closech, nil) {
+			// the context was cancelled or the connection closed
+			if err = mc.canceled.Value(); err == nil {
+				err = ErrInvalidConn
+			}
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// openInfileOnce opens a file inside of Config.LocalInfileDir, if set.
+// The opened file is checked again, since a path element might have been
+// replaced with a symlink after the path was resolved.
+func (mc *mysqlConn) openInfileOnce(path string) (*os.File, string, bool, error) {
+	dir := mc.cfg.LocalInfileDir
+	if dir == "" {
+		file, err := os.Open(path)
+		return file, path, true, err
+	}
+
+	resolved, inside, err := localInfileDirPath(dir, path)
+	if err != nil || !inside {
+		return nil, "", inside, err
+	}
+	file, err := os.Open(resolved)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	var opened, current os.FileInfo
+	again, inside, err := localInfileDirPath(dir, resolved)
+	if err == nil && inside {
+		if opened, err = file.Stat(); err == nil {
+			current, err = os.Stat(again)
+		}
+	}
+	if err != nil || !inside || again != resolved || !os.SameFile(opened, current) {
+		file.Close()
+		return nil, "", false, err
+	}
+	return file, resolved, true, nil
+}
+
+// checkInfilePeer checks the UID of the server process with
+// Config.AllowAllFilesPeerUID, if set.
+func (mc *mysqlConn) checkInfilePeer() error {
+	if mc.cfg.AllowAllFilesPeerUID == nil {
+		return nil
+	}
+
+	conn := mc.netConn
+	if mc.rawConn != nil {
+		conn = mc.rawConn
+	}
+	uid, err := peerUID(conn)
+	if err != nil {
+		return fmt.Errorf("can not verify the server peer: %v", err)
+	}
+	if !mc.cfg.AllowAllFilesPeerUID(uid) {
+		return fmt.Errorf("server peer UID %d is not allowed", uid)
+	}
+	return nil
+}
+
+// sendfileSupported reports whether netConn can send files with
+// sendfile(2). This is not possible for TLS connections.
+func (mc *mysqlConn) sendfileSupported() bool {
+	_, ok := mc.netConn.(*net.TCPConn)
+	return ok
+}
+
+// Default payload sizes of LOCAL INFILE packets.
+const (
+	readerPacketSize = 16 * 1024  // large enough for TCP and Readers
+	filePacketSize   = 256 * 1024 // larger packets save round trips for files
+)
+
+// infilePacketSize returns the payload size of LOCAL INFILE packets, which
+// is size capped by Config.InfilePacketSize and the server's packet limit.
+func (mc *mysqlConn) infilePacketSize(size int) int {
+	if mc.cfg.InfilePacketSize > 0 && mc.cfg.InfilePacketSize < size {
+		size = mc.cfg.InfilePacketSize
+	}
+	if mc.maxWriteSize < size {
+		size = mc.maxWriteSize
+	}
+	if size >= maxPacketSize {
+		size = maxPacketSize - 1
+	}
+	return size
+}
+
+// sendFile sends file from its current offset up to its end, using
+// sendfile(2) for the payload. The size of the file is checked again after
+// all data known so far was sent, so a file growing during the load is
+// sent completely, like with a buffered copy. A file truncated while it is
+// sent breaks the connection, since the packet header was already written.
+// Sending stops before the next packet once the context of the query is
+// cancelled.
+func (mc *mysqlConn) sendFile(file *os.File) (sent int64, err error) {
+	packetSize := int64(mc.infilePacketSize(filePacketSize))
+	for {
+		var fi os.FileInfo
+		if fi, err = file.Stat(); err != nil {
+			// packets might have been sent already
+			mc.cleanup()
+			return
+		}
+		if fi.Size() <= sent {
+			return
+		}
+		for remaining := fi.Size() - sent; remaining > 0; {
+			if err = mc.canceled.Value(); err != nil {
+				return
+			}
+			n := packetSize
+			if remaining < n {
+				n = remaining
+			}
+			if err = mc.writeFilePacket(file, int(n)); err != nil {
+				return
+			}
+			remaining -= n
+			sent += n
+			atomic.AddUint64(&infilePackets, 1)
+			atomic.AddUint64(&infileBytesSent, uint64(n))
+			if mc.cfg.InfileProgress != nil {
+				mc.cfg.InfileProgress(sent)
+			}
+		}
 	}
 }
 
 func (mc *mysqlConn) handleInFileRequest(name string) (err error) {
 	var rdr io.Reader
+	var plainFile *os.File // file sent without any transformation
+	var cancelled <-chan struct{}
+	var terminator []byte // appended to a Reader not ending with it
+	var checksum hash.Hash
 	var data []byte
-	packetSize := 16 * 1024 // 16KB is small enough for disk readahead and large enough for TCP
-	if mc.maxWriteSize < packetSize {
-		packetSize = mc.maxWriteSize
+	var path string // local path of a file
+	var sent int64
+	var closeErr error // error of closing a source after another error
+	var readAhead *readAheadReader
+	requested := name
+	rejected := false
+	atomic.AddUint64(&infileRequests, 1)
+	if mc.cfg.InfileAuditLog != nil {
+		defer func() {
+			mc.cfg.InfileAuditLog(InfileAuditEvent{
+				Name:      requested,
+				Path:      path,
+				Allowed:   !rejected,
+				BytesSent: sent,
+				Err:       err,
+				CloseErr:  closeErr,
+			})
+		}()
 	}
+	defer func() {
+		// deferred before the sources are closed, so it runs afterwards
+		// and a stalled Read of the read ahead is unblocked
+		if readAhead != nil {
+			readAhead.wait()
+		}
+	}()
+	packetSize := mc.infilePacketSize(readerPacketSize)
+	hintSize := 0 // size of the first packet buffer, if smaller
 
 	if idx := strings.Index(name, "Reader::"); idx == 0 || (idx > 0 && name[idx-1] == '/') { // io.Reader
 		// The server might return an an absolute path. See issue #355.
 		name = name[idx+8:]
 
-		readerRegisterLock.RLock()
-		handler, inMap := readerRegister[name]
-		readerRegisterLock.RUnlock()
+		handler, inMap := mc.infileRegistry().readerHandler(name)
+
+		if !inMap && invalidReaderName(name) {
+			// an unregistered path, the server is misbehaving
+			err = fmt.Errorf("Reader name '%s' contains a path separator or '..'", name)
+			errLog.Print(err)
+			rejected = true
+		} else if inMap {
+			var rc io.ReadCloser
+			rc, err = callReaderHandler(name, handler)
+			if rc != nil {
+				// also close a ReadCloser returned along with an error
+				defer deferredClose(&err, &closeErr, rc)
+			}
+			if err == nil {
+				if rc != nil {
+					rdr = &recoverReader{name: name, rdr: rc}
+
+					// a size hint allows a smaller first packet buffer, it
+					// is grown if the Reader provides more data
+					if size, ok := readerSize(rc); ok && size > 0 && size < int64(packetSize) {
+						hintSize = int(size)
+					}
+
+					terminator = []byte(mc.cfg.InfileReaderTerminator)
 
-		if inMap {
-			rdr = handler()
-			if rdr != nil {
-				if cl, ok := rdr.(io.Closer); ok {
-					defer deferredClose(&err, cl)
+					registry := mc.infileRegistry()
+					load := registry.startLoad(name)
+					cancelled = load.cancelled
+					defer registry.endLoad(name, load)
+
+					if rr, ok := rc.(*resumableReader); ok {
+						// don't keep waiting for a retry of a cancelled load
+						rr.closech, rr.cancelled = mc.closech, cancelled
+					}
+				} else {
+					err = fmt.Errorf("Reader '%s' is <nil>", name)
 				}
-			} else {
-				err = fmt.Errorf("Reader '%s' is <nil>", name)
 			}
 		} else {
 			err = fmt.Errorf("Reader '%s' is not registered", name)
+			rejected = true
+		}
+	} else if file := mc.infileRegistry().openLocalFile(strings.Trim(name, `"`)); file != nil { // opened File
+		var fi os.FileInfo
+
+		// read from the beginning without moving the file offset
+		if fi, err = file.Stat(); err == nil {
+			rdr = io.NewSectionReader(file, 0, fi.Size())
+			packetSize = mc.infilePacketSize(filePacketSize)
+			if fileSize := int(fi.Size()); fileSize < packetSize {
+				packetSize = fileSize
+			}
 		}
 	} else { // File
 		name = strings.Trim(name, `"`)
-		fileRegisterLock.RLock()
-		fr := fileRegister[name]
-		fileRegisterLock.RUnlock()
-		if mc.cfg.AllowAllFiles || fr {
+		registry := mc.infileRegistry()
+		var mapped bool
+		path, mapped = registry.mapLocalFile(name)
+		if !mapped {
+			path = name
+		} else if containsDotDot(path) {
+			// mapped paths bypass the whitelist, they must not escape the
+			// directory the mapper maps into
+			err = fmt.Errorf("local file '%s' is rejected: mapped path '%s' contains '..'", name, path)
+			rejected = true
+		}
+		codec, fr := registry.localFile(path)
+		allowed := err == nil && (mapped || fr)
+		if !allowed && err == nil && mc.cfg.AllowAllFiles {
+			if err = mc.checkInfilePeer(); err == nil {
+				allowed = true
+			} else {
+				err = fmt.Errorf("local file '%s' is rejected: %v", name, err)
+				rejected = true
+			}
+		}
+		if allowed {
 			var file *os.File
 			var fi os.FileInfo
 
-			if file, err = os.Open(name); err == nil {
-				defer deferredClose(&err, file)
+			var resolved string
+			var inside bool
+			if file, resolved, inside, err = mc.openInfile(path); err == nil && inside {
+				path = resolved
+			} else if err == nil {
+				err = fmt.Errorf("local file '%s' is not inside of '%s'", name, mc.cfg.LocalInfileDir)
+				rejected = true
+			}
+			if err == nil {
+				defer deferredClose(&err, &closeErr, file)
 
 				// get file size
 				if fi, err = file.Stat(); err == nil {
 					rdr = file
-					if fileSize := int(fi.Size()); fileSize < packetSize {
+					plainFile = file
+					packetSize = mc.infilePacketSize(filePacketSize)
+					// the content of a compressed file is larger than the file
+					if fileSize := int(fi.Size()); fileSize < packetSize && (codec == "" || fileSize == 0) {
 						packetSize = fileSize
 					}
 				}
+
+				if err == nil && codec != "" && packetSize > 0 {
+					var dc io.ReadCloser
+					if dc, err = decompressors[codec](file); err == nil {
+						rdr = dc
+						defer deferredClose(&err, &closeErr, dc)
+					}
+				}
 			}
-		} else {
-			err = fmt.Errorf("local file '%s' is not registered", name)
+		} else if err == nil {
+			reason := ErrLocalFileNotRegistered
+			if !registry.hasLocalFiles() {
+				reason = ErrLocalInfileDisabled
+			}
+			err = &infileError{msg: fmt.Sprintf("local file '%s' is not registered", name), err: reason}
+			rejected = true
+		}
+	}
+
+	if rejected {
+		atomic.AddUint64(&infileRejected, 1)
+	}
+
+	if hintSize == 0 {
+		hintSize = packetSize
+	}
+
+	if err == nil && packetSize > 0 && mc.cfg.InfileReadAhead {
+		readAhead = newReadAheadReader(rdr, hintSize)
+		rdr = readAhead
+		defer readAhead.Close()
+	}
+
+	// hash only the bytes sent, on this goroutine
+	if err == nil && mc.cfg.InfileChecksum != nil {
+		if checksum = mc.cfg.InfileChecksum(requested); checksum != nil {
+			rdr = io.TeeReader(rdr, checksum)
 		}
 	}
 
 	// send content packets
-	// if packetSize == 0, the Reader contains no data
-	if err == nil && packetSize > 0 {
-		data := make([]byte, 4+packetSize)
+	// if packetSize == 0, the file is empty
+	sending := err == nil
+	if err == nil && packetSize > 0 && rdr == io.Reader(plainFile) && mc.sendfileSupported() {
+		var ioErr error
+		if sent, ioErr = mc.sendFile(plainFile); ioErr != nil {
+			return ioErr
+		}
+	} else if err == nil && packetSize > 0 {
+		data := make([]byte, 4+hintSize)
+		var tail []byte // last bytes sent, to check for the terminator
 		var n int
 		for err == nil {
-			n, err = rdr.Read(data[4:])
+			select {
+			case <-cancelled:
+				err = ErrLoadCancelled
+				continue
+			default:
+			}
+			// stop reading if the context was cancelled, the connection
+			// is already closed and the terminator can't be sent anymore
+			if ioErr := mc.canceled.Value(); ioErr != nil {
+				return ioErr
+			}
+			// fill the packet, Readers may return less than requested
+			n, err = fillPacket(rdr, data[4:])
 			if n > 0 {
 				if ioErr := mc.writePacket(data[:4+n]); ioErr != nil {
 					return ioErr
 				}
+				if k := len(terminator); k > n {
+					// a short packet, the terminator may span packets
+					if tail = append(tail, data[4:4+n]...); len(tail) > k {
+						tail = tail[len(tail)-k:]
+					}
+				} else if k > 0 {
+					tail = append(tail[:0], data[4+n-k:4+n]...)
+				}
+				sent += int64(n)
+				atomic.AddUint64(&infilePackets, 1)
+				atomic.AddUint64(&infileBytesSent, uint64(n))
+				if mc.cfg.InfileProgress != nil {
+					mc.cfg.InfileProgress(sent)
+				}
+				if n == len(data)-4 && n < packetSize {
+					// the size hint was too small
+					data = make([]byte, 4+packetSize)
+				}
 			}
 		}
 		if err == io.EOF {
 			err = nil
 		}
+		if err == nil && sent > 0 && len(terminator) > 0 && !bytes.HasSuffix(tail, terminator) {
+			if ioErr := mc.writePacket(append(make([]byte, 4), terminator...)); ioErr != nil {
+				return ioErr
+			}
+			if checksum != nil {
+				checksum.Write(terminator)
+			}
+			sent += int64(len(terminator))
+			atomic.AddUint64(&infilePackets, 1)
+			atomic.AddUint64(&infileBytesSent, uint64(len(terminator)))
+			if mc.cfg.InfileProgress != nil {
+				mc.cfg.InfileProgress(sent)
+			}
+		}
+	}
+
+	if sending && err != nil && mc.cfg.InfileAbortOnError {
+		// terminating the transfer would let the server process the
+		// truncated data, closing the connection aborts the statement
+		mc.cleanup()
+		return err
+	}
+
+	// the connection is already closed if the context was cancelled, e.g.
+	// while waiting for a retry
+	if ioErr := mc.canceled.Value(); ioErr != nil {
+		return ioErr
 	}
 
 	// send empty packet (termination)
@@ -174,9 +1741,13 @@ func (mc *mysqlConn) handleInFileRequest(name string) (err error) {
 
 	// read OK packet
 	if err == nil {
-		return mc.readResultOK()
+		return mc.readInfileResultOK(requested)
 	}
 
 	mc.readPacket()
+	if _, ok := err.(*readerPanicError); ok {
+		// the state of the Reader is unknown, don't reuse the connection
+		mc.Close()
+	}
 	return err
 }
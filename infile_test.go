@@ -0,0 +1,2275 @@
+// Go MySQL Driver - A MySQL-Driver for Go's database/sql package
+//
+// Copyright 2020 The Go-MySQL-Driver Authors. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mysql
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// infileConn mocks a server which answers the empty packet terminating a
+// LOCAL INFILE transfer with an OK packet.
+type infileConn struct {
+	mockConn
+	packets [][]byte // payloads of all written packets
+	ok      []byte   // payload of the OK packet, if not the default one
+}
+
+func (c *infileConn) Write(b []byte) (int, error) {
+	n, err := c.mockConn.Write(b)
+	if err != nil {
+		return n, err
+	}
+	c.packets = append(c.packets, append([]byte(nil), b[4:]...))
+	if len(b) == 4 {
+		c.data = []byte{0x07, 0x00, 0x00, b[3] + 1, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}
+		if c.ok != nil {
+			c.data = append([]byte{byte(len(c.ok)), 0x00, 0x00, b[3] + 1}, c.ok...)
+		}
+	}
+	return n, nil
+}
+
+// payload returns the data sent in all packets.
+func (c *infileConn) payload() []byte {
+	var buf bytes.Buffer
+	for _, p := range c.packets {
+		buf.Write(p)
+	}
+	return buf.Bytes()
+}
+
+func newInfileMockConn() (*infileConn, *mysqlConn) {
+	conn := new(infileConn)
+	mc := &mysqlConn{
+		buf:              newBuffer(conn),
+		cfg:              NewConfig(),
+		netConn:          conn,
+		closech:          make(chan struct{}),
+		maxAllowedPacket: defaultMaxAllowedPacket,
+		maxWriteSize:     defaultMaxAllowedPacket,
+		sequence:         2,
+	}
+	return conn, mc
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestInFileReadCloserHandler(t *testing.T) {
+	rc := &closeRecorder{Reader: bytes.NewBufferString("1\tfoo\n")}
+	RegisterReadCloserHandler("rc", func() (io.ReadCloser, error) {
+		return rc, nil
+	})
+	defer DeregisterReaderHandler("rc")
+
+	conn, mc := newInfileMockConn()
+	if err := mc.handleInFileRequest("Reader::rc"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(conn.payload()); got != "1\tfoo\n" {
+		t.Errorf("unexpected payload: %q", got)
+	}
+	if !rc.closed {
+		t.Error("ReadCloser was not closed")
+	}
+}
+
+func TestInFileReadCloserHandlerError(t *testing.T) {
+	handlerErr := errors.New("handler failed")
+	RegisterReadCloserHandler("fail", func() (io.ReadCloser, error) {
+		return nil, handlerErr
+	})
+	defer DeregisterReaderHandler("fail")
+
+	conn, mc := newInfileMockConn()
+	if err := mc.handleInFileRequest("Reader::fail"); err != handlerErr {
+		t.Fatalf("expected %v, got %v", handlerErr, err)
+	}
+	// the transfer must still be terminated with an empty packet
+	if len(conn.packets) != 1 || len(conn.packets[0]) != 0 {
+		t.Errorf("expected only the terminating packet, got %q", conn.packets)
+	}
+
+	// a ReadCloser returned along with the error is closed as well
+	rc := &closeRecorder{Reader: bytes.NewBufferString("1\tfoo\n")}
+	RegisterReadCloserHandler("fail", func() (io.ReadCloser, error) {
+		return rc, handlerErr
+	})
+	_, mc = newInfileMockConn()
+	if err := mc.handleInFileRequest("Reader::fail"); err != handlerErr {
+		t.Fatalf("expected %v, got %v", handlerErr, err)
+	}
+	if !rc.closed {
+		t.Error("ReadCloser returned with an error was not closed")
+	}
+}
+
+func TestInFileReaderHandler(t *testing.T) {
+	RegisterReaderHandler("plain", func() io.Reader {
+		return bytes.NewBufferString("plain data")
+	})
+	RegisterReaderHandler("nil", func() io.Reader {
+		return nil
+	})
+	defer DeregisterReaderHandler("plain")
+	defer DeregisterReaderHandler("nil")
+
+	conn, mc := newInfileMockConn()
+	if err := mc.handleInFileRequest("Reader::plain"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(conn.payload()); got != "plain data" {
+		t.Errorf("unexpected payload: %q", got)
+	}
+
+	_, mc = newInfileMockConn()
+	err := mc.handleInFileRequest("Reader::nil")
+	if err == nil || err.Error() != "Reader 'nil' is <nil>" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestInFileLocalInfileDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outside, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	inside := filepath.Join(dir, "inside.csv")
+	secret := filepath.Join(outside, "secret.csv")
+	link := filepath.Join(dir, "link.csv")
+	if err := ioutil.WriteFile(inside, []byte("1\tinside\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(secret, []byte("1\tsecret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secret, link); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+
+	conn, mc := newInfileMockConn()
+	mc.cfg.AllowAllFiles = true
+	mc.cfg.LocalInfileDir = dir
+	if err := mc.handleInFileRequest(inside); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(conn.payload()); got != "1\tinside\n" {
+		t.Errorf("unexpected payload: %q", got)
+	}
+
+	for _, name := range []string{secret, link, filepath.Join(dir, "..", filepath.Base(outside), "secret.csv")} {
+		conn, mc = newInfileMockConn()
+		mc.cfg.AllowAllFiles = true
+		mc.cfg.LocalInfileDir = dir
+		err := mc.handleInFileRequest(name)
+		if err == nil || !strings.Contains(err.Error(), "is not inside of") {
+			t.Errorf("%s: expected rejection, got %v", name, err)
+		}
+		if got := conn.payload(); len(got) != 0 {
+			t.Errorf("%s: unexpected payload: %q", name, got)
+		}
+	}
+}
+
+func TestInFileOpenRetries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "rotated.csv")
+
+	// without retries a missing file fails immediately
+	_, mc := newInfileMockConn()
+	mc.cfg.AllowAllFiles = true
+	if err := mc.handleInFileRequest(name); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error, got %v", err)
+	}
+
+	created := make(chan error, 1)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		created <- ioutil.WriteFile(name, []byte("1\trotated\n"), 0600)
+	}()
+
+	conn, mc := newInfileMockConn()
+	mc.cfg.AllowAllFiles = true
+	mc.cfg.InfileOpenRetries = 10
+	mc.cfg.InfileOpenBackoff = 5 * time.Millisecond
+	if err := mc.handleInFileRequest(name); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-created; err != nil {
+		t.Fatal(err)
+	}
+	if got := string(conn.payload()); got != "1\trotated\n" {
+		t.Errorf("unexpected payload: %q", got)
+	}
+
+	// the file is resolved inside of localInfileDir on every attempt
+	name = filepath.Join(dir, "rotated-dir.csv")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		created <- ioutil.WriteFile(name, []byte("1\trotated in dir\n"), 0600)
+	}()
+
+	conn, mc = newInfileMockConn()
+	mc.cfg.AllowAllFiles = true
+	mc.cfg.LocalInfileDir = dir
+	mc.cfg.InfileOpenRetries = 10
+	mc.cfg.InfileOpenBackoff = 5 * time.Millisecond
+	if err := mc.handleInFileRequest(name); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-created; err != nil {
+		t.Fatal(err)
+	}
+	if got := string(conn.payload()); got != "1\trotated in dir\n" {
+		t.Errorf("unexpected payload: %q", got)
+	}
+
+	// cancelling the context stops waiting for the file
+	_, mc = newInfileMockConn()
+	mc.cfg.AllowAllFiles = true
+	mc.cfg.InfileOpenRetries = 10
+	mc.cfg.InfileOpenBackoff = time.Second
+	time.AfterFunc(20*time.Millisecond, func() {
+		mc.cancel(context.Canceled)
+	})
+	start := time.Now()
+	if err := mc.handleInFileRequest(filepath.Join(dir, "missing.csv")); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("cancelled load kept waiting for the file for %v", elapsed)
+	}
+}
+
+func TestInFileCompressedLocalFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	zw := gzip.NewWriter(file)
+	zw.Write([]byte("1\tcompressed\n2\tdata\n"))
+	zw.Close()
+	file.Close()
+
+	if err := RegisterCompressedLocalFile(file.Name(), "gzip"); err != nil {
+		t.Fatal(err)
+	}
+	defer DeregisterLocalFile(file.Name())
+
+	conn, mc := newInfileMockConn()
+	if err := mc.handleInFileRequest(file.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(conn.payload()); got != "1\tcompressed\n2\tdata\n" {
+		t.Errorf("unexpected payload: %q", got)
+	}
+
+	if err := RegisterCompressedLocalFile(file.Name(), "rar"); err == nil {
+		t.Error("expected error for unknown codec")
+	}
+
+	// the packets are not limited by the size of the compressed file
+	file, err = os.Create(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("1\tcompressed\n"), 1024*1024/14)
+	zw = gzip.NewWriter(file)
+	zw.Write(content)
+	zw.Close()
+	file.Close()
+	if err := RegisterCompressedLocalFile(file.Name(), "gzip"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, mc = newInfileMockConn()
+	if err := mc.handleInFileRequest(file.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(conn.payload(), content) {
+		t.Errorf("unexpected payload of %d bytes", len(conn.payload()))
+	}
+	// 4 data packets of up to 256KB and the terminating packet
+	if len(conn.packets) != 5 {
+		t.Errorf("expected 5 packets, got %d", len(conn.packets))
+	}
+}
+
+func TestInFileCompressedReaderHandler(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte("1\tcompressed\n2\tdata\n"))
+	zw.Close()
+
+	rc := &closeRecorder{Reader: &compressed}
+	if err := RegisterCompressedReaderHandler("gzip", "gzip", func() io.Reader {
+		return rc
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer DeregisterReaderHandler("gzip")
+
+	conn, mc := newInfileMockConn()
+	if err := mc.handleInFileRequest("Reader::gzip"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(conn.payload()); got != "1\tcompressed\n2\tdata\n" {
+		t.Errorf("unexpected payload: %q", got)
+	}
+	if !rc.closed {
+		t.Error("compressed Reader was not closed")
+	}
+
+	// printf '1\ta\n2\tb\n' | bzip2
+	bz := []byte{
+		0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x33, 0xe7,
+		0xb8, 0xf9, 0x00, 0x00, 0x02, 0x49, 0x00, 0x00, 0x30, 0x30, 0x00, 0x30,
+		0x00, 0x20, 0x00, 0x21, 0xa6, 0x99, 0xa0, 0xc0, 0x3e, 0x00, 0x85, 0x85,
+		0xdc, 0x91, 0x4e, 0x14, 0x24, 0x0c, 0xf9, 0xee, 0x3e, 0x40,
+	}
+	if err := RegisterCompressedReaderHandler("bzip2", "bzip2", func() io.Reader {
+		return bytes.NewReader(bz)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer DeregisterReaderHandler("bzip2")
+
+	conn, mc = newInfileMockConn()
+	if err := mc.handleInFileRequest("Reader::bzip2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(conn.payload()); got != "1\ta\n2\tb\n" {
+		t.Errorf("unexpected payload: %q", got)
+	}
+
+	// not a gzip stream
+	rc = &closeRecorder{Reader: bytes.NewBufferString("1\tplain\n")}
+	conn, mc = newInfileMockConn()
+	if err := mc.handleInFileRequest("Reader::gzip"); err == nil {
+		t.Error("expected error for invalid gzip data")
+	}
+	if !rc.closed {
+		t.Error("Reader was not closed after decompressor error")
+	}
+
+	if err := RegisterCompressedReaderHandler("zstd", "zstd", func() io.Reader {
+		return nil
+	}); err == nil {
+		t.Error("expected error for unknown codec")
+	}
+}
+
+func TestInFileHTTPReaderHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/data.csv" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "1\thttp\n2\tdata\n")
+	}))
+	defer ts.Close()
+
+	RegisterHTTPReaderHandler("http", ts.URL+"/data.csv", ts.Client())
+	RegisterHTTPReaderHandler("notFound", ts.URL+"/missing.csv", nil)
+	defer DeregisterReaderHandler("http")
+	defer DeregisterReaderHandler("notFound")
+
+	conn, mc := newInfileMockConn()
+	if err := mc.handleInFileRequest("Reader::http"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(conn.payload()); got != "1\thttp\n2\tdata\n" {
+		t.Errorf("unexpected payload: %q", got)
+	}
+
+	_, mc = newInfileMockConn()
+	err := mc.handleInFileRequest("Reader::notFound")
+	if err == nil || !strings.Contains(err.Error(), "404 Not Found") {
+		t.Errorf("expected 404 error, got %v", err)
+	}
+}
+
+func TestInFileSpillingReaderHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := strings.Repeat("1\tspilled\n", 10000)
+	rc := &closeRecorder{Reader: strings.NewReader(content)}
+	RegisterSpillingReaderHandler("spill", func() io.Reader {
+		return rc
+	}, dir)
+	RegisterSpillingReaderHandler("spillErr", func() io.Reader {
+		return io.MultiReader(strings.NewReader("1\tfoo\n"), errReader{errors.New("cursor failed")})
+	}, dir)
+	defer DeregisterReaderHandler("spill")
+	defer DeregisterReaderHandler("spillErr")
+
+	conn, mc := newInfileMockConn()
+	sentBeforeClose := false
+	mc.cfg.InfileProgress = func(bytesSent int64) {
+		if !rc.closed {
+			sentBeforeClose = true
+		}
+	}
+	if err := mc.handleInFileRequest("Reader::spill"); err != nil {
+		t.Fatal(err)
+	}
+	if sentBeforeClose {
+		t.Error("data was sent before the source Reader was closed")
+	}
+	if got := string(conn.payload()); got != content {
+		t.Errorf("unexpected payload of %d bytes, expected %d bytes", len(got), len(content))
+	}
+
+	_, mc = newInfileMockConn()
+	if err := mc.handleInFileRequest("Reader::spillErr"); err == nil || err.Error() != "cursor failed" {
+		t.Errorf("expected cursor error, got %v", err)
+	}
+
+	// the temporary files are removed after success and failure
+	if files, err := ioutil.ReadDir(dir); err != nil || len(files) != 0 {
+		t.Errorf("expected no temporary files, got %d (%v)", len(files), err)
+	}
+}
+
+func TestInFileResumableReaderHandler(t *testing.T) {
+	content := strings.Repeat("1\tresumed\n", 1000)
+	errBlip := errors.New("connection reset")
+
+	// every source breaks after 3000 bytes
+	var offsets []int64
+	RegisterResumableReaderHandler("resumable", func(offset int64) (io.ReadCloser, error) {
+		offsets = append(offsets, offset)
+		src := io.LimitReader(strings.NewReader(content[offset:]), 3000)
+		if offset+3000 >= int64(len(content)) {
+			return ioutil.NopCloser(src), nil
+		}
+		return ioutil.NopCloser(io.MultiReader(src, errReader{errBlip})), nil
+	}, ResumeOptions{MaxRetries: 3, Backoff: time.Millisecond})
+	defer DeregisterReaderHandler("resumable")
+
+	conn, mc := newInfileMockConn()
+	if err := mc.handleInFileRequest("Reader::resumable"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(conn.payload()); got != content {
+		t.Errorf("unexpected payload of %d bytes, expected %d bytes", len(got), len(content))
+	}
+	if want := []int64{0, 3000, 6000, 9000}; !reflect.DeepEqual(offsets, want) {
+		t.Errorf("expected offsets %v, got %v", want, offsets)
+	}
+
+	// retries are counted per load, even if the source makes progress
+	opens := 0
+	RegisterResumableReaderHandler("broken", func(offset int64) (io.ReadCloser, error) {
+		opens++
+		return ioutil.NopCloser(io.MultiReader(strings.NewReader("1"), errReader{errBlip})), nil
+	}, ResumeOptions{MaxRetries: 3, Backoff: 10 * time.Millisecond})
+	defer DeregisterReaderHandler("broken")
+
+	_, mc = newInfileMockConn()
+	start := time.Now()
+	if err := mc.handleInFileRequest("Reader::broken"); err != errBlip {
+		t.Errorf("expected %v, got %v", errBlip, err)
+	}
+	if opens != 4 {
+		t.Errorf("expected 4 opens, got %d", opens)
+	}
+	// 10ms + 20ms + 40ms backoff
+	if elapsed := time.Since(start); elapsed < 70*time.Millisecond {
+		t.Errorf("expected retries to back off, took %v", elapsed)
+	}
+
+	// permanent errors are not retried, neither of reads nor of reopens
+	errDenied := errors.New("access denied")
+	errNotFound := errors.New("not found")
+	opens = 0
+	RegisterResumableReaderHandler("permanent", func(offset int64) (io.ReadCloser, error) {
+		opens++
+		if offset > 0 {
+			return nil, errNotFound
+		}
+		return ioutil.NopCloser(io.MultiReader(strings.NewReader("1"), errReader{errBlip})), nil
+	}, ResumeOptions{MaxRetries: 3, Backoff: time.Millisecond, Permanent: func(err error) bool {
+		return err == errNotFound || err == errDenied
+	}})
+	defer DeregisterReaderHandler("permanent")
+
+	_, mc = newInfileMockConn()
+	if err := mc.handleInFileRequest("Reader::permanent"); err != errNotFound {
+		t.Errorf("expected %v, got %v", errNotFound, err)
+	}
+	if opens != 2 {
+		t.Errorf("expected 2 opens, got %d", opens)
+	}
+
+	opens = 0
+	RegisterResumableReaderHandler("permanent", func(offset int64) (io.ReadCloser, error) {
+		opens++
+		return ioutil.NopCloser(errReader{errDenied}), nil
+	}, ResumeOptions{MaxRetries: 3, Backoff: time.Millisecond, Permanent: func(err error) bool {
+		return err == errDenied
+	}})
+
+	_, mc = newInfileMockConn()
+	if err := mc.handleInFileRequest("Reader::permanent"); err != errDenied {
+		t.Errorf("expected %v, got %v", errDenied, err)
+	}
+	if opens != 1 {
+		t.Errorf("expected 1 open, got %d", opens)
+	}
+}
+
+// funcReader calls read before it returns err.
+type funcReader struct {
+	read func()
+	err  error
+}
+
+func (r funcReader) Read(p []byte) (int, error) {
+	r.read()
+	return 0, r.err
+}
+
+func TestInFileResumableReaderCancel(t *testing.T) {
+	errBlip := errors.New("connection reset")
+	var mc *mysqlConn
+	tests := []struct {
+		name   string
+		cancel func()
+		want   error
+	}{
+		{"resumableCancel", func() { CancelReader("resumableCancel") }, ErrLoadCancelled},
+		{"resumableContext", func() { mc.cancel(context.Canceled) }, context.Canceled},
+	}
+	for _, tst := range tests {
+		cancel := tst.cancel
+		RegisterResumableReaderHandler(tst.name, func(offset int64) (io.ReadCloser, error) {
+			// cancel the load while it backs off
+			return ioutil.NopCloser(funcReader{read: cancel, err: errBlip}), nil
+		}, ResumeOptions{MaxRetries: 10, Backoff: time.Second})
+
+		_, mc = newInfileMockConn()
+		start := time.Now()
+		if err := mc.handleInFileRequest("Reader::" + tst.name); err != tst.want {
+			t.Errorf("%s: expected %v, got %v", tst.name, tst.want, err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("%s: cancelled load kept backing off for %v", tst.name, elapsed)
+		}
+		DeregisterReaderHandler(tst.name)
+	}
+}
+
+func TestInFileMultiFileReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	contents := []string{"1\ta\n2\tb", "", "3\tc\n", "4\td"}
+	var paths []string
+	for i, content := range contents {
+		path := filepath.Join(dir, fmt.Sprintf("shard%d.csv", i))
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	RegisterMultiFileReader("shards", paths)
+	defer DeregisterReaderHandler("shards")
+
+	conn, mc := newInfileMockConn()
+	if err := mc.handleInFileRequest("Reader::shards"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(conn.payload()), "1\ta\n2\tb\n3\tc\n4\td"; got != want {
+		t.Errorf("unexpected payload: got %q, want %q", got, want)
+	}
+
+	// a missing file aborts the load
+	RegisterMultiFileReader("missing", []string{paths[0], filepath.Join(dir, "doesnotexist")})
+	defer DeregisterReaderHandler("missing")
+	_, mc = newInfileMockConn()
+	if err := mc.handleInFileRequest("Reader::missing"); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
+
+func TestInFileProgress(t *testing.T) {
+	RegisterReaderHandler("progress", func() io.Reader {
+		return bytes.NewReader(make([]byte, 100*1024))
+	})
+	defer DeregisterReaderHandler("progress")
+
+	var progress []int64
+	_, mc := newInfileMockConn()
+	mc.cfg.InfileProgress = func(bytesSent int64) {
+		progress = append(progress, bytesSent)
+	}
+	if err := mc.handleInFileRequest("Reader::progress"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 100KB are sent in 16KB packets
+	if len(progress) != 7 {
+		t.Fatalf("expected 7 progress calls, got %d: %v", len(progress), progress)
+	}
+	for i := 1; i < len(progress); i++ {
+		if progress[i] <= progress[i-1] {
+			t.Errorf("progress is not increasing: %v", progress)
+		}
+	}
+	if last := progress[len(progress)-1]; last != 100*1024 {
+		t.Errorf("expected %d bytes sent, got %d", 100*1024, last)
+	}
+}
+
+func TestInFileCancelReader(t *testing.T) {
+	RegisterReaderHandler("cancel", func() io.Reader {
+		return bytes.NewReader(make([]byte, 100*1024))
+	})
+	defer DeregisterReaderHandler("cancel")
+
+	// no active load
+	CancelReader("cancel")
+
+	conn, mc := newInfileMockConn()
+	mc.cfg.InfileProgress = func(bytesSent int64) {
+		CancelReader("cancel")
+	}
+	if err := mc.handleInFileRequest("Reader::cancel"); err != ErrLoadCancelled {
+		t.Fatalf("expected ErrLoadCancelled, got %v", err)
+	}
+	if n := len(conn.payload()); n != 16*1024 {
+		t.Errorf("expected one packet of %d bytes, got %d bytes", 16*1024, n)
+	}
+	if n := len(defaultInfileRegistry.loads); n != 0 {
+		t.Errorf("expected no active loads, got %d", n)
+	}
+
+	// a new load of the Reader is not affected by an earlier cancel
+	conn, mc = newInfileMockConn()
+	if err := mc.handleInFileRequest("Reader::cancel"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(conn.payload()); n != 100*1024 {
+		t.Errorf("expected %d bytes, got %d bytes", 100*1024, n)
+	}
+}
+
+func TestInFileReaderNameTraversal(t *testing.T) {
+	previous := errLog
+	defer func() {
+		errLog = previous
+	}()
+	buffer := bytes.NewBuffer(make([]byte, 0, 64))
+	SetLogger(log.New(buffer, "", 0))
+
+	before := Stats()
+	for _, name := range []string{"../../secret", "dir/data", `dir\data`, ".."} {
+		buffer.Reset()
+		_, mc := newInfileMockConn()
+		err := mc.handleInFileRequest("Reader::" + name)
+		if err == nil || !strings.Contains(err.Error(), "path separator") {
+			t.Errorf("%s: expected path separator error, got %v", name, err)
+			continue
+		}
+		if !strings.Contains(buffer.String(), err.Error()) {
+			t.Errorf("%s: expected rejection to be logged, got %q", name, buffer.String())
+		}
+	}
+	if rejected := Stats().Rejected - before.Rejected; rejected != 4 {
+		t.Errorf("expected 4 rejected requests, got %d", rejected)
+	}
+
+	// registered names are loaded, also if they look like paths
+	for _, name := range []string{"exports/2020", "a..b"} {
+		RegisterReaderHandler(name, func() io.Reader {
+			return strings.NewReader("1\tregistered\n")
+		})
+		conn, mc := newInfileMockConn()
+		if err := mc.handleInFileRequest("Reader::" + name); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if got := string(conn.payload()); got != "1\tregistered\n" {
+			t.Errorf("%s: unexpected payload: %q", name, got)
+		}
+		DeregisterReaderHandler(name)
+	}
+
+	// an unregistered name with ".." inside of a path element is no path
+	_, mc := newInfileMockConn()
+	err := mc.handleInFileRequest("Reader::a..b")
+	if err == nil || err.Error() != "Reader 'a..b' is not registered" {
+		t.Errorf("expected not registered error, got %v", err)
+	}
+
+	// the absolute path prefix of the server is not part of the name
+	_, mc = newInfileMockConn()
+	err = mc.handleInFileRequest("/var/lib/mysql/Reader::unknown")
+	if err == nil || err.Error() != "Reader 'unknown' is not registered" {
+		t.Errorf("expected not registered error, got %v", err)
+	}
+}
+
+func TestInFileInfo(t *testing.T) {
+	RegisterReaderHandler("info", func() io.Reader {
+		return bytes.NewBufferString("1\ta\n1\tb\n2\tc\n")
+	})
+	defer DeregisterReaderHandler("info")
+
+	const info = "Records: 3  Deleted: 0  Skipped: 1  Warnings: 1"
+	conn, mc := newInfileMockConn()
+	conn.ok = append([]byte{0x00, 0x02, 0x00, 0x02, 0x00, 0x01, 0x00}, info...)
+
+	var gotName string
+	var got LoadDataInfo
+	mc.cfg.InfileInfo = func(name string, info LoadDataInfo) {
+		gotName, got = name, info
+	}
+	if err := mc.handleInFileRequest("Reader::info"); err != nil {
+		t.Fatal(err)
+	}
+	want := LoadDataInfo{Info: info, Records: 3, Skipped: 1, Warnings: 1}
+	if gotName != "Reader::info" || got != want {
+		t.Errorf("got %q %+v, want %q %+v", gotName, got, "Reader::info", want)
+	}
+	if mc.affectedRows != 2 {
+		t.Errorf("expected 2 affected rows, got %d", mc.affectedRows)
+	}
+
+	// OK packet without info
+	conn, mc = newInfileMockConn()
+	mc.cfg.InfileInfo = func(name string, info LoadDataInfo) {
+		got = info
+	}
+	if err := mc.handleInFileRequest("Reader::info"); err != nil {
+		t.Fatal(err)
+	}
+	if got != (LoadDataInfo{}) {
+		t.Errorf("expected empty info, got %+v", got)
+	}
+}
+
+// oneByteReader returns a single byte per Read.
+type oneByteReader struct {
+	rdr io.Reader
+}
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return r.rdr.Read(p)
+}
+
+func TestInFileShortReads(t *testing.T) {
+	RegisterReaderHandler("short", func() io.Reader {
+		return &oneByteReader{rdr: bytes.NewReader(make([]byte, 40*1024))}
+	})
+	defer DeregisterReaderHandler("short")
+
+	conn, mc := newInfileMockConn()
+	if err := mc.handleInFileRequest("Reader::short"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 40KB are sent in two full packets and a short final one
+	var sizes []int
+	for _, p := range conn.packets {
+		sizes = append(sizes, len(p))
+	}
+	if want := []int{16 * 1024, 16 * 1024, 8 * 1024, 0}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("expected packet sizes %v, got %v", want, sizes)
+	}
+
+	// errors of the Reader are returned unchanged
+	RegisterReaderHandler("truncated", func() io.Reader {
+		return io.MultiReader(bytes.NewBufferString("1\tfoo\n"), errReader{io.ErrUnexpectedEOF})
+	})
+	defer DeregisterReaderHandler("truncated")
+
+	_, mc = newInfileMockConn()
+	if err := mc.handleInFileRequest("Reader::truncated"); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+// sizeReader reports a fixed size hint.
+type sizeReader struct {
+	io.Reader
+	size int64
+}
+
+func (r *sizeReader) Size() int64 {
+	return r.size
+}
+
+func TestInFileReaderSize(t *testing.T) {
+	RegisterReaderHandler("small", func() io.Reader {
+		return bytes.NewReader(make([]byte, 100))
+	})
+	RegisterReaderHandler("wrongSize", func() io.Reader {
+		return &sizeReader{Reader: bytes.NewReader(make([]byte, 100)), size: 40}
+	})
+	RegisterReaderHandler("zeroSize", func() io.Reader {
+		return &sizeReader{Reader: bytes.NewReader(make([]byte, 100)), size: 0}
+	})
+	RegisterReaderHandler("tooSmall", func() io.Reader {
+		return &sizeReader{Reader: bytes.NewReader(make([]byte, 40000)), size: 10}
+	})
+	RegisterReaderHandler("empty", func() io.Reader {
+		return strings.NewReader("")
+	})
+	defer DeregisterReaderHandler("small")
+	defer DeregisterReaderHandler("wrongSize")
+	defer DeregisterReaderHandler("zeroSize")
+	defer DeregisterReaderHandler("tooSmall")
+	defer DeregisterReaderHandler("empty")
+
+	tests := []struct {
+		name  string
+		sizes []int
+	}{
+		{"small", []int{100, 0}},
+		// too small hints only limit the first packet
+		{"wrongSize", []int{40, 60, 0}},
+		{"zeroSize", []int{100, 0}},
+		{"tooSmall", []int{10, 16384, 16384, 7222, 0}},
+		{"empty", []int{0}},
+	}
+	for _, tst := range tests {
+		conn, mc := newInfileMockConn()
+		if err := mc.handleInFileRequest("Reader::" + tst.name); err != nil {
+			t.Fatal(err)
+		}
+		var sizes []int
+		for _, p := range conn.packets {
+			sizes = append(sizes, len(p))
+		}
+		if !reflect.DeepEqual(sizes, tst.sizes) {
+			t.Errorf("%s: expected packet sizes %v, got %v", tst.name, tst.sizes, sizes)
+		}
+	}
+}
+
+type errCloser struct {
+	err error
+}
+
+func (c errCloser) Close() error {
+	return c.err
+}
+
+func TestDeferredClose(t *testing.T) {
+	previous := errLog
+	defer func() {
+		errLog = previous
+	}()
+	buffer := bytes.NewBuffer(make([]byte, 0, 64))
+	SetLogger(log.New(buffer, "", 0))
+
+	errClose1 := errors.New("close 1 failed")
+	errClose2 := errors.New("close 2 failed")
+
+	tests := []struct {
+		err     error
+		closers []io.Closer
+		want    error
+		dropped error
+		logged  string
+	}{
+		{nil, []io.Closer{errCloser{nil}}, nil, nil, ""},
+		{nil, []io.Closer{errCloser{errClose1}}, errClose1, nil, ""},
+		{ErrLoadCancelled, []io.Closer{errCloser{nil}}, ErrLoadCancelled, nil, ""},
+		{ErrLoadCancelled, []io.Closer{errCloser{errClose1}}, ErrLoadCancelled, errClose1, "close after error: close 1 failed\n"},
+		{ErrInvalidConn, []io.Closer{errCloser{errClose1}, errCloser{errClose2}}, ErrInvalidConn, errClose1, "close after error: close 1 failed\nclose after error: close 2 failed\n"},
+	}
+	for i, tst := range tests {
+		buffer.Reset()
+		err := tst.err
+		var dropped error
+		for _, c := range tst.closers {
+			deferredClose(&err, &dropped, c)
+		}
+		if err != tst.want {
+			t.Errorf("%d: expected %v, got %v", i, tst.want, err)
+		}
+		if dropped != tst.dropped {
+			t.Errorf("%d: expected dropped close error %v, got %v", i, tst.dropped, dropped)
+		}
+		if got := buffer.String(); got != tst.logged {
+			t.Errorf("%d: expected log %q, got %q", i, tst.logged, got)
+		}
+	}
+}
+
+func TestLocalInfileSupported(t *testing.T) {
+	_, mc := newInfileMockConn()
+	if mc.LocalInfileSupported() {
+		t.Error("expected LOCAL INFILE to be unsupported without capability flag")
+	}
+	mc.flags = clientProtocol41 | clientLocalFiles
+	if !mc.LocalInfileSupported() {
+		t.Error("expected LOCAL INFILE to be supported with capability flag")
+	}
+}
+
+func TestInFileAbortOnError(t *testing.T) {
+	errRead := errors.New("read failed")
+	RegisterReaderHandler("abort", func() io.Reader {
+		return io.MultiReader(bytes.NewBufferString("1\tfoo\n"), errReader{errRead})
+	})
+	defer DeregisterReaderHandler("abort")
+
+	for _, abort := range []bool{false, true} {
+		conn, mc := newInfileMockConn()
+		mc.cfg.InfileAbortOnError = abort
+		if err := mc.handleInFileRequest("Reader::abort"); err != errRead {
+			t.Fatalf("abort=%t: expected %v, got %v", abort, errRead, err)
+		}
+
+		terminated := len(conn.packets[len(conn.packets)-1]) == 0
+		if terminated == abort {
+			t.Errorf("abort=%t: transfer terminated: %t", abort, terminated)
+		}
+		if conn.closed != abort {
+			t.Errorf("abort=%t: connection closed: %t", abort, conn.closed)
+		}
+	}
+
+	// errors before sending don't close the connection
+	conn, mc := newInfileMockConn()
+	mc.cfg.InfileAbortOnError = true
+	if err := mc.handleInFileRequest("Reader::unknown"); err == nil {
+		t.Fatal("expected error for unknown Reader")
+	}
+	if conn.closed {
+		t.Error("connection was closed for an unknown Reader")
+	}
+}
+
+func TestInFileAuditLog(t *testing.T) {
+	file, err := ioutil.TempFile("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("1\tfile\n")
+	file.Close()
+	RegisterLocalFile(file.Name())
+	defer DeregisterLocalFile(file.Name())
+
+	RegisterReaderHandler("audit", func() io.Reader {
+		return bytes.NewBufferString("1\treader\n")
+	})
+	defer DeregisterReaderHandler("audit")
+
+	errRead := errors.New("read failed")
+	errClose := errors.New("close failed")
+	RegisterReadCloserHandler("auditClose", func() (io.ReadCloser, error) {
+		return struct {
+			io.Reader
+			io.Closer
+		}{errReader{errRead}, errCloser{errClose}}, nil
+	})
+	defer DeregisterReaderHandler("auditClose")
+
+	tests := []struct {
+		name string
+		want InfileAuditEvent
+	}{
+		{"Reader::audit", InfileAuditEvent{Name: "Reader::audit", Allowed: true, BytesSent: 9}},
+		{file.Name(), InfileAuditEvent{Name: file.Name(), Path: file.Name(), Allowed: true, BytesSent: 7}},
+		{"/etc/passwd", InfileAuditEvent{Name: "/etc/passwd", Path: "/etc/passwd", Allowed: false}},
+		{"Reader::unknown", InfileAuditEvent{Name: "Reader::unknown", Allowed: false}},
+		// the error of Close is reported along with the read error
+		{"Reader::auditClose", InfileAuditEvent{Name: "Reader::auditClose", Allowed: true, CloseErr: errClose}},
+	}
+	for _, tst := range tests {
+		var events []InfileAuditEvent
+		_, mc := newInfileMockConn()
+		mc.cfg.InfileAuditLog = func(event InfileAuditEvent) {
+			// the registry must not be locked while user code is called
+			DeregisterLocalFile("none")
+			DeregisterReaderHandler("none")
+			events = append(events, event)
+		}
+		reqErr := mc.handleInFileRequest(tst.name)
+
+		if len(events) != 1 {
+			t.Fatalf("%s: expected 1 event, got %d", tst.name, len(events))
+		}
+		got := events[0]
+		if got.Err != reqErr {
+			t.Errorf("%s: expected error %v, got %v", tst.name, reqErr, got.Err)
+		}
+		got.Err = nil
+		if got != tst.want {
+			t.Errorf("%s: expected %+v, got %+v", tst.name, tst.want, got)
+		}
+	}
+}
+
+func TestInFileNotRegisteredErrors(t *testing.T) {
+	registry := NewInfileRegistry()
+	_, mc := newInfileMockConn()
+	mc.cfg.InfileRegistry = registry
+
+	unwrap := func(err error) error {
+		if w, ok := err.(interface{ Unwrap() error }); ok {
+			return w.Unwrap()
+		}
+		return nil
+	}
+
+	// empty whitelist
+	err := mc.handleInFileRequest("/tmp/a.csv")
+	if err == nil || err.Error() != "local file '/tmp/a.csv' is not registered" {
+		t.Fatalf("expected not registered error, got %v", err)
+	}
+	if unwrap(err) != ErrLocalInfileDisabled {
+		t.Errorf("expected ErrLocalInfileDisabled, got %v", unwrap(err))
+	}
+
+	// file missing in whitelist
+	registry.RegisterLocalFile("/tmp/b.csv")
+	_, mc = newInfileMockConn()
+	mc.cfg.InfileRegistry = registry
+	err = mc.handleInFileRequest("/tmp/a.csv")
+	if err == nil || err.Error() != "local file '/tmp/a.csv' is not registered" {
+		t.Fatalf("expected not registered error, got %v", err)
+	}
+	if unwrap(err) != ErrLocalFileNotRegistered {
+		t.Errorf("expected ErrLocalFileNotRegistered, got %v", unwrap(err))
+	}
+}
+
+func TestInFileRegistryConcurrency(t *testing.T) {
+	file, err := ioutil.TempFile("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("1\tfoo\n")
+	file.Close()
+
+	registry := NewInfileRegistry()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	// register and deregister while loads are running
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			registry.RegisterLocalFile(file.Name())
+			registry.RegisterReaderHandler("data", func() io.Reader {
+				return strings.NewReader("1\tfoo\n")
+			})
+			registry.RegisteredLocalFiles()
+			registry.RegisteredReaderHandlers()
+			registry.CancelReader("data")
+			if i%2 == 0 {
+				registry.DeregisterLocalFile(file.Name())
+				registry.DeregisterReaderHandler("data")
+			} else {
+				registry.DeregisterAllLocalFiles()
+				registry.DeregisterAllReaderHandlers()
+			}
+		}
+	}()
+
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				for _, name := range []string{file.Name(), "Reader::data"} {
+					_, mc := newInfileMockConn()
+					mc.cfg.InfileRegistry = registry
+					mc.handleInFileRequest(name)
+				}
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	close(done)
+	wg.Wait()
+}
+
+func TestCheckReaderHandler(t *testing.T) {
+	errRead := errors.New("read failed")
+	rc := &closeRecorder{Reader: strings.NewReader("1\tfoo\n")}
+	RegisterReadCloserHandler("ok", func() (io.ReadCloser, error) {
+		return rc, nil
+	})
+	RegisterReaderHandler("empty", func() io.Reader {
+		return strings.NewReader("")
+	})
+	RegisterReaderHandler("nil", func() io.Reader {
+		return nil
+	})
+	RegisterReaderHandler("failing", func() io.Reader {
+		return errReader{errRead}
+	})
+	RegisterReaderHandler("panic", func() io.Reader {
+		return panicReader{}
+	})
+	for _, name := range []string{"ok", "empty", "nil", "failing", "panic"} {
+		defer DeregisterReaderHandler(name)
+	}
+
+	tests := []struct {
+		name    string
+		wantErr string
+	}{
+		{"ok", ""},
+		{"empty", ""},
+		{"nil", "Reader 'nil' is <nil>"},
+		{"failing", "read failed"},
+		{"panic", "Reader 'panic' panicked: read failed"},
+		{"unknown", "Reader 'unknown' is not registered"},
+	}
+	for _, tst := range tests {
+		err := CheckReaderHandler(tst.name)
+		if tst.wantErr == "" && err != nil {
+			t.Errorf("%s: %v", tst.name, err)
+		} else if tst.wantErr != "" && (err == nil || err.Error() != tst.wantErr) {
+			t.Errorf("%s: expected %q, got %v", tst.name, tst.wantErr, err)
+		}
+	}
+	if !rc.closed {
+		t.Error("Reader was not closed")
+	}
+}
+
+type panicReader struct{}
+
+func (panicReader) Read(p []byte) (int, error) {
+	panic("read failed")
+}
+
+func TestInFileReaderPanic(t *testing.T) {
+	RegisterReaderHandler("panicHandler", func() io.Reader {
+		panic("handler failed")
+	})
+	RegisterReaderHandler("panicRead", func() io.Reader {
+		return io.MultiReader(bytes.NewBufferString("1\tfoo\n"), panicReader{})
+	})
+	defer DeregisterReaderHandler("panicHandler")
+	defer DeregisterReaderHandler("panicRead")
+
+	for _, name := range []string{"panicHandler", "panicRead"} {
+		conn, mc := newInfileMockConn()
+		err := mc.handleInFileRequest("Reader::" + name)
+		if _, ok := err.(*readerPanicError); !ok {
+			t.Errorf("%s: expected readerPanicError, got %T: %v", name, err, err)
+		}
+		// the transfer must be terminated before the connection is closed
+		if last := conn.packets[len(conn.packets)-1]; len(last) != 1 || last[0] != comQuit {
+			t.Errorf("%s: expected COM_QUIT after terminating packet, got %q", name, conn.packets)
+		}
+		if prev := conn.packets[len(conn.packets)-2]; len(prev) != 0 {
+			t.Errorf("%s: expected terminating packet, got %q", name, prev)
+		}
+		if !mc.closed.IsSet() {
+			t.Errorf("%s: connection was not closed", name)
+		}
+	}
+}
+
+func TestDeregisterAll(t *testing.T) {
+	RegisterLocalFile("/tmp/a.csv")
+	RegisterLocalFile("/tmp/b.csv")
+	RegisterReaderHandler("a", func() io.Reader { return nil })
+	DeregisterAllLocalFiles()
+	DeregisterAllReaderHandlers()
+
+	_, mc := newInfileMockConn()
+	if err := mc.handleInFileRequest("/tmp/a.csv"); err == nil || err.Error() != "local file '/tmp/a.csv' is not registered" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	_, mc = newInfileMockConn()
+	if err := mc.handleInFileRequest("Reader::a"); err == nil || err.Error() != "Reader 'a' is not registered" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// calling them on empty registries must not fail
+	DeregisterAllLocalFiles()
+	DeregisterAllReaderHandlers()
+	RegisterLocalFile("/tmp/a.csv")
+	DeregisterAllLocalFiles()
+}
+
+func TestRegisteredInfiles(t *testing.T) {
+	DeregisterAllLocalFiles()
+	DeregisterAllReaderHandlers()
+	if files, readers := RegisteredLocalFiles(), RegisteredReaderHandlers(); len(files) != 0 || len(readers) != 0 {
+		t.Fatalf("expected empty registries, got %q and %q", files, readers)
+	}
+
+	RegisterLocalFile("/tmp/b.csv")
+	RegisterLocalFile(`"/tmp/a.csv"`)
+	RegisterReaderHandler("b", func() io.Reader { return nil })
+	RegisterReaderHandler("a", func() io.Reader { return nil })
+	defer DeregisterAllLocalFiles()
+	defer DeregisterAllReaderHandlers()
+
+	files := RegisteredLocalFiles()
+	if want := []string{"/tmp/a.csv", "/tmp/b.csv"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("expected %q, got %q", want, files)
+	}
+	readers := RegisteredReaderHandlers()
+	if want := []string{"a", "b"}; !reflect.DeepEqual(readers, want) {
+		t.Errorf("expected %q, got %q", want, readers)
+	}
+
+	// the returned slices are copies
+	files[0] = "/etc/passwd"
+	if RegisteredLocalFiles()[0] != "/tmp/a.csv" {
+		t.Error("registry was modified through the returned slice")
+	}
+}
+
+func TestInFileRegistryScope(t *testing.T) {
+	RegisterReaderHandler("scoped", func() io.Reader {
+		return bytes.NewBufferString("global")
+	})
+	defer DeregisterReaderHandler("scoped")
+
+	registry := NewInfileRegistry()
+	registry.RegisterReaderHandler("scoped", func() io.Reader {
+		return bytes.NewBufferString("scoped")
+	})
+	registry.RegisterLocalFile("/tmp/scoped.csv")
+
+	conn, mc := newInfileMockConn()
+	mc.cfg.InfileRegistry = registry
+	if err := mc.handleInFileRequest("Reader::scoped"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(conn.payload()); got != "scoped" {
+		t.Errorf("unexpected payload: %q", got)
+	}
+
+	conn, mc = newInfileMockConn()
+	if err := mc.handleInFileRequest("Reader::scoped"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(conn.payload()); got != "global" {
+		t.Errorf("unexpected payload: %q", got)
+	}
+
+	// files registered in a registry are not visible globally and vice versa
+	if files := RegisteredLocalFiles(); len(files) != 0 {
+		t.Errorf("unexpected global files: %q", files)
+	}
+	RegisterLocalFile("/tmp/global.csv")
+	defer DeregisterLocalFile("/tmp/global.csv")
+	_, mc = newInfileMockConn()
+	mc.cfg.InfileRegistry = registry
+	if err := mc.handleInFileRequest("/tmp/global.csv"); err == nil || err.Error() != "local file '/tmp/global.csv' is not registered" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestInFileRegistryZeroValue(t *testing.T) {
+	file, err := ioutil.TempFile("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("1\tfile\n")
+	file.Close()
+
+	opened, err := os.Open(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer opened.Close()
+
+	for _, registry := range []*InfileRegistry{{}, new(InfileRegistry)} {
+		if files := registry.RegisteredLocalFiles(); len(files) != 0 {
+			t.Errorf("unexpected files: %q", files)
+		}
+		registry.DeregisterLocalFile(file.Name())
+		registry.DeregisterReaderHandler("zero")
+		registry.RegisterLocalFile(file.Name())
+		registry.RegisterLocalFileReader("opened", opened)
+		registry.RegisterReaderHandler("zero", func() io.Reader {
+			return strings.NewReader("1\treader\n")
+		})
+
+		conn, mc := newInfileMockConn()
+		mc.cfg.InfileRegistry = registry
+		if err := mc.handleInFileRequest(file.Name()); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(conn.payload()); got != "1\tfile\n" {
+			t.Errorf("unexpected payload: %q", got)
+		}
+		conn, mc = newInfileMockConn()
+		mc.cfg.InfileRegistry = registry
+		if err := mc.handleInFileRequest("Reader::zero"); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(conn.payload()); got != "1\treader\n" {
+			t.Errorf("unexpected payload: %q", got)
+		}
+
+		// usable again after removing everything
+		registry.DeregisterAllLocalFiles()
+		registry.DeregisterAllReaderHandlers()
+		registry.RegisterLocalFile(file.Name())
+		registry.RegisterReaderHandler("zero", func() io.Reader { return nil })
+	}
+}
+
+func TestInFileLocalFilePathMapper(t *testing.T) {
+	file, err := ioutil.TempFile("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("1\tmapped\n")
+	file.Close()
+
+	registry := NewInfileRegistry()
+	registry.RegisterLocalFilePathMapper(func(serverPath string) (string, bool) {
+		if serverPath == "/var/data/x.csv" {
+			return file.Name(), true
+		}
+		return "", false
+	})
+
+	conn, mc := newInfileMockConn()
+	mc.cfg.InfileRegistry = registry
+	if err := mc.handleInFileRequest("/var/data/x.csv"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(conn.payload()); got != "1\tmapped\n" {
+		t.Errorf("unexpected payload: %q", got)
+	}
+
+	// unmapped paths must still be whitelisted
+	_, mc = newInfileMockConn()
+	mc.cfg.InfileRegistry = registry
+	if err := mc.handleInFileRequest(file.Name()); err == nil || !strings.Contains(err.Error(), "is not registered") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	registry.RegisterLocalFile(file.Name())
+	conn, mc = newInfileMockConn()
+	mc.cfg.InfileRegistry = registry
+	if err := mc.handleInFileRequest(file.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(conn.payload()); got != "1\tmapped\n" {
+		t.Errorf("unexpected payload: %q", got)
+	}
+}
+
+func TestInFileLocalFilePathMapperTraversal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "x.csv"), []byte("1\tmapped\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "secret.csv"), []byte("1\tsecret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// a naive mapper, which would allow traversal with uncleaned paths
+	registry := NewInfileRegistry()
+	registry.RegisterLocalFilePathMapper(func(serverPath string) (string, bool) {
+		if strings.HasPrefix(serverPath, "/var/data/") {
+			return root + "/" + strings.TrimPrefix(serverPath, "/var/data/"), true
+		}
+		if !filepath.IsAbs(serverPath) {
+			return root + "/" + serverPath, true
+		}
+		return "", false
+	})
+
+	conn, mc := newInfileMockConn()
+	mc.cfg.InfileRegistry = registry
+	if err := mc.handleInFileRequest("/var/data/./x.csv"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(conn.payload()); got != "1\tmapped\n" {
+		t.Errorf("unexpected payload: %q", got)
+	}
+
+	tests := []struct {
+		name          string
+		allowAllFiles bool
+		err           string
+	}{
+		// cleaned paths outside of /var/data are not mapped
+		{"/var/data/../secret.csv", false, "is not registered"},
+		{"/var/data/../.." + filepath.Join(dir, "secret.csv"), false, "is not registered"},
+		// mapped paths containing ".." are rejected, even with allowAllFiles
+		{"../secret.csv", false, "contains '..'"},
+		{"../secret.csv", true, "contains '..'"},
+	}
+	for _, test := range tests {
+		conn, mc := newInfileMockConn()
+		mc.cfg.InfileRegistry = registry
+		mc.cfg.AllowAllFiles = test.allowAllFiles
+		err := mc.handleInFileRequest(test.name)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error containing %q, got %v", test.name, test.err, err)
+		}
+		if got := conn.payload(); len(got) != 0 {
+			t.Errorf("%s: unexpected payload: %q", test.name, got)
+		}
+	}
+}
+
+func TestInFileChecksum(t *testing.T) {
+	content := strings.Repeat("1\tchecksummed row\n", 5000)
+	RegisterReaderHandler("checksum", func() io.Reader {
+		return strings.NewReader(content)
+	})
+	defer DeregisterReaderHandler("checksum")
+
+	h := crc32.NewIEEE()
+	var requested string
+	_, mc := newInfileMockConn()
+	mc.cfg.InfileChecksum = func(name string) hash.Hash {
+		requested = name
+		return h
+	}
+	if err := mc.handleInFileRequest("Reader::checksum"); err != nil {
+		t.Fatal(err)
+	}
+	if requested != "Reader::checksum" {
+		t.Errorf("unexpected name: %q", requested)
+	}
+	if got, want := h.Sum32(), crc32.ChecksumIEEE([]byte(content)); got != want {
+		t.Errorf("checksum mismatch: got %x, want %x", got, want)
+	}
+
+	// an appended line terminator is part of the checksum
+	RegisterReaderHandler("checksum", func() io.Reader {
+		return strings.NewReader(strings.TrimSuffix(content, "\n"))
+	})
+	h.Reset()
+	conn, mc := newInfileMockConn()
+	mc.cfg.InfileReaderTerminator = "\n"
+	mc.cfg.InfileChecksum = func(string) hash.Hash {
+		return h
+	}
+	if err := mc.handleInFileRequest("Reader::checksum"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := h.Sum32(), crc32.ChecksumIEEE(conn.payload()); got != want {
+		t.Errorf("checksum with terminator mismatch: got %x, want %x", got, want)
+	}
+}
+
+func TestInFileLocalFileReader(t *testing.T) {
+	file, err := ioutil.TempFile("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	file.WriteString("1\topen file\n")
+
+	RegisterLocalFileReader("open.csv", file)
+	defer DeregisterLocalFile("open.csv")
+
+	// the file can be loaded repeatedly and even after it was removed
+	os.Remove(file.Name())
+	for i := 0; i < 2; i++ {
+		conn, mc := newInfileMockConn()
+		if err := mc.handleInFileRequest("open.csv"); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(conn.payload()); got != "1\topen file\n" {
+			t.Errorf("unexpected payload: %q", got)
+		}
+	}
+
+	// the driver doesn't close the file
+	if _, err := file.Stat(); err != nil {
+		t.Errorf("file was closed: %v", err)
+	}
+
+	DeregisterLocalFile("open.csv")
+	_, mc := newInfileMockConn()
+	if err := mc.handleInFileRequest("open.csv"); err == nil || err.Error() != "local file 'open.csv' is not registered" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestInFileStats(t *testing.T) {
+	RegisterReaderHandler("stats", func() io.Reader {
+		return bytes.NewReader(make([]byte, 20*1024))
+	})
+	defer DeregisterReaderHandler("stats")
+
+	before := Stats()
+	_, mc := newInfileMockConn()
+	if err := mc.handleInFileRequest("Reader::stats"); err != nil {
+		t.Fatal(err)
+	}
+	_, mc = newInfileMockConn()
+	if err := mc.handleInFileRequest("/etc/passwd"); err == nil {
+		t.Fatal("expected error for unregistered file")
+	}
+	after := Stats()
+
+	if d := after.Requests - before.Requests; d != 2 {
+		t.Errorf("expected 2 requests, got %d", d)
+	}
+	if d := after.Rejected - before.Rejected; d != 1 {
+		t.Errorf("expected 1 rejected request, got %d", d)
+	}
+	if d := after.Packets - before.Packets; d != 2 {
+		t.Errorf("expected 2 packets, got %d", d)
+	}
+	if d := after.BytesSent - before.BytesSent; d != 20*1024 {
+		t.Errorf("expected %d bytes, got %d", 20*1024, d)
+	}
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestInFileReadAhead(t *testing.T) {
+	content := strings.Repeat("1\tread ahead\n", 10000)
+	readErr := errors.New("read failed")
+	RegisterReaderHandler("readAhead", func() io.Reader {
+		return strings.NewReader(content)
+	})
+	RegisterReaderHandler("readAheadErr", func() io.Reader {
+		return io.MultiReader(strings.NewReader(content), errReader{readErr})
+	})
+	defer DeregisterReaderHandler("readAhead")
+	defer DeregisterReaderHandler("readAheadErr")
+
+	conn, mc := newInfileMockConn()
+	mc.cfg.InfileReadAhead = true
+	if err := mc.handleInFileRequest("Reader::readAhead"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(conn.payload()); got != content {
+		t.Errorf("payload mismatch: got %d bytes, want %d", len(got), len(content))
+	}
+
+	conn, mc = newInfileMockConn()
+	mc.cfg.InfileReadAhead = true
+	if err := mc.handleInFileRequest("Reader::readAheadErr"); err != readErr {
+		t.Errorf("expected %v, got %v", readErr, err)
+	}
+	if got := string(conn.payload()); got != content {
+		t.Errorf("payload mismatch: got %d bytes, want %d", len(got), len(content))
+	}
+}
+
+// stallingReader returns data and then blocks until it is closed, like a
+// stalled network source.
+type stallingReader struct {
+	data   []byte
+	closed chan struct{}
+}
+
+func (r *stallingReader) Read(p []byte) (int, error) {
+	if len(r.data) > 0 {
+		n := copy(p, r.data)
+		r.data = r.data[n:]
+		return n, nil
+	}
+	<-r.closed
+	return 0, errors.New("read from closed Reader")
+}
+
+func (r *stallingReader) Close() error {
+	close(r.closed)
+	return nil
+}
+
+func TestInFileReadAheadStalled(t *testing.T) {
+	rdr := &stallingReader{data: []byte("1\tstalled\n"), closed: make(chan struct{})}
+	RegisterReaderHandler("stalled", func() io.Reader {
+		return rdr
+	})
+	defer DeregisterReaderHandler("stalled")
+
+	_, mc := newInfileMockConn()
+	mc.cfg.InfileReadAhead = true
+	mc.cfg.InfilePacketSize = len(rdr.data)
+	mc.cfg.InfileProgress = func(int64) {
+		// cancel while the next Read stalls
+		mc.cancel(context.Canceled)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- mc.handleInFileRequest("Reader::stalled")
+	}()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("expected %v, got %v", context.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("load hangs on a stalled Reader")
+	}
+	select {
+	case <-rdr.closed:
+	default:
+		t.Error("Reader was not closed")
+	}
+}
+
+func TestInFileReadAheadChecksum(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(strings.Repeat("1\tread ahead checksum\n", 20000)))
+	zw.Close()
+	if err := RegisterCompressedReaderHandler("readAheadChecksum", "gzip", func() io.Reader {
+		return bytes.NewReader(compressed.Bytes())
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer DeregisterReaderHandler("readAheadChecksum")
+
+	// run with -race: the hash must not be written after the load returned
+	h := crc32.NewIEEE()
+	conn, mc := newInfileMockConn()
+	mc.cfg.InfileReadAhead = true
+	mc.cfg.InfileChecksum = func(string) hash.Hash {
+		return h
+	}
+	mc.cfg.InfileProgress = func(int64) {
+		CancelReader("readAheadChecksum")
+	}
+	if err := mc.handleInFileRequest("Reader::readAheadChecksum"); err != ErrLoadCancelled {
+		t.Fatalf("expected %v, got %v", ErrLoadCancelled, err)
+	}
+	if got, want := h.Sum32(), crc32.ChecksumIEEE(conn.payload()); got != want {
+		t.Errorf("checksum of the sent data mismatch: got %x, want %x", got, want)
+	}
+}
+
+// slowReader simulates a Reader with latency, e.g. a disk or network.
+type slowReader struct {
+	remaining int
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(100 * time.Microsecond)
+	if len(p) > r.remaining {
+		p = p[:r.remaining]
+	}
+	r.remaining -= len(p)
+	return len(p), nil
+}
+
+// slowInfileConn simulates the latency of sending a packet.
+type slowInfileConn struct {
+	infileConn
+}
+
+func (c *slowInfileConn) Write(b []byte) (int, error) {
+	time.Sleep(100 * time.Microsecond)
+	c.packets, c.written = c.packets[:0], c.written[:0]
+	return c.infileConn.Write(b)
+}
+
+func benchmarkInFile(b *testing.B, readAhead bool) {
+	const size = 1024 * 1024
+	RegisterReaderHandler("bench", func() io.Reader {
+		return &slowReader{remaining: size}
+	})
+	defer DeregisterReaderHandler("bench")
+
+	b.SetBytes(size)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		conn := new(slowInfileConn)
+		mc := &mysqlConn{
+			buf:              newBuffer(conn),
+			cfg:              NewConfig(),
+			netConn:          conn,
+			closech:          make(chan struct{}),
+			maxAllowedPacket: defaultMaxAllowedPacket,
+			maxWriteSize:     defaultMaxAllowedPacket,
+			sequence:         2,
+		}
+		mc.cfg.InfileReadAhead = readAhead
+		if err := mc.handleInFileRequest("Reader::bench"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInFile(b *testing.B) {
+	benchmarkInFile(b, false)
+}
+
+func BenchmarkInFileReadAhead(b *testing.B) {
+	benchmarkInFile(b, true)
+}
+
+// newInfileTCPConn connects to a server on the loopback interface, which
+// answers every LOCAL INFILE transfer with an OK packet. The payload of each
+// transfer is sent to the returned channel if collect is true.
+func newInfileTCPConn(tb testing.TB, collect bool) (*mysqlConn, <-chan []byte) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	payloads := make(chan []byte, 1)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var payload []byte
+		header := make([]byte, 4)
+		buf := make([]byte, maxPacketSize)
+		for {
+			if _, err := io.ReadFull(conn, header); err != nil {
+				return
+			}
+			n := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+			if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+				return
+			}
+			if collect {
+				payload = append(payload, buf[:n]...)
+			}
+			if n == 0 {
+				conn.Write([]byte{0x07, 0x00, 0x00, header[3] + 1, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00})
+				payloads <- payload
+				payload = nil
+			}
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	mc := &mysqlConn{
+		buf:              newBuffer(conn),
+		cfg:              NewConfig(),
+		netConn:          conn,
+		closech:          make(chan struct{}),
+		maxAllowedPacket: defaultMaxAllowedPacket,
+		maxWriteSize:     defaultMaxAllowedPacket,
+		sequence:         2,
+	}
+	return mc, payloads
+}
+
+// wrappedConn hides the type of a net.Conn, which disables sendfile.
+type wrappedConn struct {
+	net.Conn
+}
+
+func TestInFileSendfile(t *testing.T) {
+	file, err := ioutil.TempFile("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	content := make([]byte, 100*1024+123)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	file.Write(content)
+	file.Close()
+
+	RegisterLocalFile(file.Name())
+	defer DeregisterLocalFile(file.Name())
+
+	for _, sendfile := range []bool{true, false} {
+		mc, payloads := newInfileTCPConn(t, true)
+		if !mc.sendfileSupported() {
+			t.Fatal("expected sendfile support for TCP connections")
+		}
+		if !sendfile {
+			mc.netConn = wrappedConn{mc.netConn}
+		}
+		mc.maxWriteSize = 30 * 1024 // send several packets
+		var progress []int64
+		mc.cfg.InfileProgress = func(bytesSent int64) {
+			progress = append(progress, bytesSent)
+		}
+
+		if err := mc.handleInFileRequest(file.Name()); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-payloads; !bytes.Equal(got, content) {
+			t.Errorf("sendfile=%t: unexpected payload of %d bytes", sendfile, len(got))
+		}
+		if len(progress) < 4 || progress[len(progress)-1] != int64(len(content)) {
+			t.Errorf("sendfile=%t: unexpected progress %v", sendfile, progress)
+		}
+		mc.netConn.Close()
+	}
+}
+
+func TestInFileSendfileGrowing(t *testing.T) {
+	content := make([]byte, 100*1024)
+	appended := bytes.Repeat([]byte("1\tappended\n"), 1000)
+
+	for _, sendfile := range []bool{true, false} {
+		file, err := ioutil.TempFile("", "gotest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(file.Name())
+		file.Write(content)
+		RegisterLocalFile(file.Name())
+		defer DeregisterLocalFile(file.Name())
+
+		mc, payloads := newInfileTCPConn(t, true)
+		if !sendfile {
+			mc.netConn = wrappedConn{mc.netConn}
+		}
+		mc.cfg.InfilePacketSize = 32 * 1024
+		var progress []int64
+		mc.cfg.InfileProgress = func(bytesSent int64) {
+			if len(progress) == 0 {
+				// the file grows while it is sent
+				file.Write(appended)
+			}
+			progress = append(progress, bytesSent)
+		}
+
+		if err := mc.handleInFileRequest(file.Name()); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		if got := <-payloads; !bytes.Equal(got, append(content, appended...)) {
+			t.Errorf("sendfile=%t: unexpected payload of %d bytes", sendfile, len(got))
+		}
+		var last int64
+		for _, sent := range progress {
+			if sent-last > 32*1024 {
+				t.Errorf("sendfile=%t: packet of %d bytes is larger than infilePacketSize", sendfile, sent-last)
+			}
+			last = sent
+		}
+		mc.netConn.Close()
+	}
+}
+
+func benchmarkInFileTCP(b *testing.B, sendfile bool) {
+	file, err := ioutil.TempFile("", "gotest")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	const size = 16 * 1024 * 1024
+	file.Write(make([]byte, size))
+	file.Close()
+
+	RegisterLocalFile(file.Name())
+	defer DeregisterLocalFile(file.Name())
+
+	mc, payloads := newInfileTCPConn(b, false)
+	defer mc.netConn.Close()
+	if !sendfile {
+		mc.netConn = wrappedConn{mc.netConn}
+	}
+
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := mc.handleInFileRequest(file.Name()); err != nil {
+			b.Fatal(err)
+		}
+		<-payloads
+	}
+}
+
+func BenchmarkInFileTCP(b *testing.B) {
+	benchmarkInFileTCP(b, false)
+}
+
+func BenchmarkInFileSendfile(b *testing.B) {
+	benchmarkInFileTCP(b, true)
+}
+
+// chunkReader returns at most 512 bytes per Read, like a network connection
+// receiving small segments.
+type chunkReader struct {
+	remaining int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	n := len(p)
+	if n > 512 {
+		n = 512
+	}
+	if n > r.remaining {
+		n = r.remaining
+	}
+	r.remaining -= n
+	return n, nil
+}
+
+func benchmarkInFileChunks(b *testing.B, wrap func(io.Reader) io.Reader) {
+	const size = 4 * 1024 * 1024
+	RegisterReaderHandler("chunks", func() io.Reader {
+		return wrap(&chunkReader{remaining: size})
+	})
+	defer DeregisterReaderHandler("chunks")
+
+	b.SetBytes(size)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, mc := newInfileMockConn()
+		if err := mc.handleInFileRequest("Reader::chunks"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInFileUnbufferedReader(b *testing.B) {
+	benchmarkInFileChunks(b, func(r io.Reader) io.Reader { return r })
+}
+
+func BenchmarkInFileBufferedReader(b *testing.B) {
+	benchmarkInFileChunks(b, func(r io.Reader) io.Reader { return bufio.NewReaderSize(r, 16*1024) })
+}
+
+func TestInFilePacketSize(t *testing.T) {
+	file, err := ioutil.TempFile("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.Write(make([]byte, 600*1024))
+	file.Close()
+
+	RegisterLocalFile(file.Name())
+	defer DeregisterLocalFile(file.Name())
+
+	tests := []struct {
+		packetSize int
+		max        int
+	}{
+		{0, 256 * 1024},
+		{64 * 1024, 64 * 1024},
+		{1024 * 1024, 256 * 1024},
+	}
+	for _, test := range tests {
+		conn, mc := newInfileMockConn()
+		mc.cfg.InfilePacketSize = test.packetSize
+		if err := mc.handleInFileRequest(file.Name()); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(conn.packets[0]); got != test.max {
+			t.Errorf("packetSize=%d: expected packets of %d bytes, got %d", test.packetSize, test.max, got)
+		}
+		if got := len(conn.payload()); got != 600*1024 {
+			t.Errorf("packetSize=%d: unexpected payload of %d bytes", test.packetSize, got)
+		}
+	}
+}
+
+func benchmarkInFilePacketSize(b *testing.B, packetSize int) {
+	file, err := ioutil.TempFile("", "gotest")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	const size = 16 * 1024 * 1024
+	file.Write(make([]byte, size))
+	file.Close()
+
+	RegisterLocalFile(file.Name())
+	defer DeregisterLocalFile(file.Name())
+
+	mc, payloads := newInfileTCPConn(b, false)
+	defer mc.netConn.Close()
+	mc.netConn = wrappedConn{mc.netConn} // disable sendfile
+	mc.cfg.InfilePacketSize = packetSize
+
+	packets := Stats().Packets
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := mc.handleInFileRequest(file.Name()); err != nil {
+			b.Fatal(err)
+		}
+		<-payloads
+	}
+	b.StopTimer()
+	b.Logf("%d packets per load", (Stats().Packets-packets)/uint64(b.N))
+}
+
+func BenchmarkInFilePacketSize16K(b *testing.B) {
+	benchmarkInFilePacketSize(b, 16*1024)
+}
+
+func BenchmarkInFilePacketSizeDefault(b *testing.B) {
+	benchmarkInFilePacketSize(b, 0)
+}
+
+// countingHash counts the bytes written to a hash.Hash.
+type countingHash struct {
+	hash.Hash
+	n int
+}
+
+func (h *countingHash) Write(p []byte) (int, error) {
+	h.n += len(p)
+	return h.Hash.Write(p)
+}
+
+func TestInFileContextCancel(t *testing.T) {
+	file, err := ioutil.TempFile("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	const size = 8 * 1024 * 1024
+	file.Write(make([]byte, size))
+	file.Close()
+
+	RegisterLocalFile(file.Name())
+	defer DeregisterLocalFile(file.Name())
+
+	// open file descriptors, if the platform lists them
+	openFDs := func() int {
+		fds, err := ioutil.ReadDir("/proc/self/fd")
+		if err != nil {
+			return -1
+		}
+		return len(fds)
+	}
+
+	conn, mc := newInfileMockConn()
+	mc.cfg.InfileProgress = func(int64) {
+		// what the context watcher does when the context is cancelled
+		mc.cancel(context.Canceled)
+	}
+	read := &countingHash{Hash: crc32.NewIEEE()}
+	mc.cfg.InfileChecksum = func(string) hash.Hash {
+		return read
+	}
+	fds := openFDs()
+	if err := mc.handleInFileRequest(file.Name()); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if len(conn.packets) != 1 {
+		t.Errorf("expected to stop after the first packet, sent %d", len(conn.packets))
+	}
+	if read.n != len(conn.packets[0]) {
+		t.Errorf("read %d bytes after the context was cancelled", read.n-len(conn.packets[0]))
+	}
+	if got := openFDs(); got != fds {
+		t.Errorf("file was not closed: %d open files, expected %d", got, fds)
+	}
+
+	// sendfile
+	mc, _ = newInfileTCPConn(t, false)
+	var sent int64
+	mc.cfg.InfileProgress = func(bytesSent int64) {
+		sent = bytesSent
+		mc.cancel(context.Canceled)
+	}
+	mc.maxWriteSize = 64 * 1024
+	if err := mc.handleInFileRequest(file.Name()); err != context.Canceled {
+		t.Fatalf("sendfile: expected %v, got %v", context.Canceled, err)
+	}
+	if sent != 64*1024 {
+		t.Errorf("sendfile: expected to stop after the first packet, sent %d bytes", sent)
+	}
+}
+
+func TestInFileReaderTerminator(t *testing.T) {
+	tests := []struct {
+		terminator string
+		content    string
+		want       string
+	}{
+		{"\n", "1\ta\n2\tb", "1\ta\n2\tb\n"},
+		{"\n", "1\ta\n2\tb\n", "1\ta\n2\tb\n"},
+		{"\n", "", ""},
+		{"\r\n", "1\ta\r\n2\tb\n", "1\ta\r\n2\tb\n\r\n"},
+		{"\r\n", "1\ta\r\n2\tb\r\n", "1\ta\r\n2\tb\r\n"},
+		{"", "1\ta\n2\tb", "1\ta\n2\tb"},
+	}
+	for _, test := range tests {
+		content := test.content
+		RegisterReaderHandler("terminator", func() io.Reader {
+			return strings.NewReader(content)
+		})
+		for _, packetSize := range []int{0, 1, 5} {
+			conn, mc := newInfileMockConn()
+			mc.cfg.InfileReaderTerminator = test.terminator
+			mc.cfg.InfilePacketSize = packetSize
+			if err := mc.handleInFileRequest("Reader::terminator"); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(conn.payload()); got != test.want {
+				t.Errorf("%q with packets of %d bytes: expected %q, got %q", test.content, packetSize, test.want, got)
+			}
+		}
+	}
+	DeregisterReaderHandler("terminator")
+
+	// files are sent unchanged
+	file, err := ioutil.TempFile("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("1\ta")
+	file.Close()
+	RegisterLocalFile(file.Name())
+	defer DeregisterLocalFile(file.Name())
+
+	conn, mc := newInfileMockConn()
+	mc.cfg.InfileReaderTerminator = "\n"
+	if err := mc.handleInFileRequest(file.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(conn.payload()); got != "1\ta" {
+		t.Errorf("unexpected file payload: %q", got)
+	}
+}
+
+func TestInFileMultiFileReaderTerminator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	second := filepath.Join(dir, "second.csv")
+	if err := ioutil.WriteFile(second, []byte("2\tb"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		terminator string
+		first      string
+		want       string
+	}{
+		{"\n", "1\ta\n", "1\ta\n2\tb"},
+		{"\n", "1\ta\r\n", "1\ta\r\n2\tb"},
+		{"\n", "1\ta", "1\ta\n2\tb"},
+		{"\r\n", "1\ta\r\n", "1\ta\r\n2\tb"},
+		{"\r\n", "1\ta\n", "1\ta\n2\tb"},
+		{"\r\n", "1\ta\r", "1\ta\r\n2\tb"},
+		{"\r\n", "1\ta", "1\ta\r\n2\tb"},
+	}
+	for i, tst := range tests {
+		first := filepath.Join(dir, "first.csv")
+		if err := ioutil.WriteFile(first, []byte(tst.first), 0600); err != nil {
+			t.Fatal(err)
+		}
+		RegisterMultiFileReaderTerminator("terminator", []string{first, second}, tst.terminator)
+
+		conn, mc := newInfileMockConn()
+		if err := mc.handleInFileRequest("Reader::terminator"); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(conn.payload()); got != tst.want {
+			t.Errorf("%d: got %q, want %q", i, got, tst.want)
+		}
+	}
+	DeregisterReaderHandler("terminator")
+}
+
+func TestMultiFileReaderTail(t *testing.T) {
+	// the terminator may be split across reads
+	r := &multiFileReader{terminator: "\r\n"}
+	r.appendTail([]byte("abc\r"))
+	r.appendTail([]byte("\n"))
+	if got := r.missingTerminator(); got != "" {
+		t.Errorf("expected complete terminator, missing %q", got)
+	}
+	r.appendTail([]byte("x"))
+	if got := r.missingTerminator(); got != "\r\n" {
+		t.Errorf("expected missing terminator, got %q", got)
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"os"
 	"time"
 )
 
@@ -177,6 +178,41 @@ func (mc *mysqlConn) writePacket(data []byte) error {
 	}
 }
 
+// writeFilePacket writes a packet of the next n bytes of file. The payload is
+// copied with io.CopyN, which uses sendfile(2) if netConn supports it.
+// The packet must be smaller than maxPacketSize.
+func (mc *mysqlConn) writeFilePacket(file *os.File, n int) error {
+	header := []byte{byte(n), byte(n >> 8), byte(n >> 16), mc.sequence}
+
+	if mc.writeTimeout > 0 {
+		if err := mc.netConn.SetWriteDeadline(time.Now().Add(mc.writeTimeout)); err != nil {
+			return err
+		}
+	}
+
+	written, err := mc.netConn.Write(header)
+	if err == nil {
+		var copied int64
+		copied, err = io.CopyN(mc.netConn, file, int64(n))
+		written += int(copied)
+	}
+	if err == nil {
+		mc.sequence++
+		return nil
+	}
+
+	// Handle error
+	if cerr := mc.canceled.Value(); cerr != nil {
+		return cerr
+	}
+	if written == 0 {
+		return errBadConnNoWrite
+	}
+	mc.cleanup()
+	errLog.Print(err)
+	return ErrInvalidConn
+}
+
 /******************************************************************************
 *                           Initialization Process                            *
 ******************************************************************************/
@@ -630,6 +666,21 @@ func (mc *mysqlConn) handleOkPacket(data []byte) error {
 	return nil
 }
 
+// okPacketInfo returns the human readable info string of an OK packet,
+// e.g. "Records: 3  Deleted: 0  Skipped: 0  Warnings: 0".
+func okPacketInfo(data []byte) string {
+	// header, affected rows and insert id
+	_, _, n := readLengthEncodedInteger(data[1:])
+	_, _, m := readLengthEncodedInteger(data[1+n:])
+
+	// server_status and warning count [2 bytes each]
+	pos := 1 + n + m + 4
+	if pos >= len(data) {
+		return ""
+	}
+	return string(data[pos:])
+}
+
 // Read Packets as Field Packets until EOF-Packet or an Error appears
 // http://dev.mysql.com/doc/internals/en/com-query-response.html#packet-Protocol::ColumnDefinition41
 func (mc *mysqlConn) readColumns(count int) ([]mysqlField, error) {
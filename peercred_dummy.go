@@ -0,0 +1,20 @@
+// Go MySQL Driver - A MySQL-Driver for Go's database/sql package
+//
+// Copyright 2020 The Go-MySQL-Driver Authors. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build !linux
+
+package mysql
+
+import (
+	"errors"
+	"net"
+)
+
+func peerUID(conn net.Conn) (int, error) {
+	return 0, errors.New("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,82 @@
+// Go MySQL Driver - A MySQL-Driver for Go's database/sql package
+//
+// Copyright 2020 The Go-MySQL-Driver Authors. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build linux
+
+package mysql
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInFileAllowAllFilesPeerUID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := filepath.Join(dir, "data.csv")
+	if err := ioutil.WriteFile(data, []byte("1\tfoo\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("unix", filepath.Join(dir, "mysql.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	sock, err := net.Dial("unix", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+
+	uid := os.Getuid()
+	tests := []struct {
+		conn    net.Conn
+		allowed func(int) bool
+		wantErr string
+	}{
+		{sock, func(peer int) bool { return peer == uid }, ""},
+		{sock, func(peer int) bool { return peer != uid }, "is not allowed"},
+		{nil, func(peer int) bool { return true }, "can not verify"},
+	}
+	for i, tst := range tests {
+		conn, mc := newInfileMockConn()
+		mc.rawConn = tst.conn
+		mc.cfg.AllowAllFiles = true
+		mc.cfg.AllowAllFilesPeerUID = tst.allowed
+
+		err := mc.handleInFileRequest(data)
+		if tst.wantErr == "" {
+			if err != nil {
+				t.Errorf("%d: %v", i, err)
+			} else if got := string(conn.payload()); got != "1\tfoo\n" {
+				t.Errorf("%d: unexpected payload: %q", i, got)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tst.wantErr) {
+			t.Errorf("%d: expected error containing %q, got %v", i, tst.wantErr, err)
+		}
+	}
+
+	// whitelisted files are not checked
+	RegisterLocalFile(data)
+	defer DeregisterLocalFile(data)
+	_, mc := newInfileMockConn()
+	mc.cfg.AllowAllFiles = true
+	mc.cfg.AllowAllFilesPeerUID = func(int) bool { return false }
+	if err := mc.handleInFileRequest(data); err != nil {
+		t.Error(err)
+	}
+}